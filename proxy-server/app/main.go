@@ -2,91 +2,223 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"proxy-server/pkg/api"
+	"proxy-server/pkg/config"
 	"proxy-server/pkg/proxy"
 	"proxy-server/pkg/repository"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const PROXYPORT = 8080
-
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	settings, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	connectionString := fmt.Sprintf("mongodb://%s:%s@%s:%d", "root", "example", "mongo", 27017)
-	mongoConnection, err := mongo.Connect(ctx, options.Client().ApplyURI(connectionString))
+	proxyConfig, err := settings.ProxyConfig()
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	requests := repository.NewMongoRequestSaver(mongoConnection)
-	responses := repository.NewMongoResponseSaver(mongoConnection)
+	store, err := openStorage(settings)
+	if err != nil {
+		fmt.Println(settings.Storage.Backend+":", err)
+		os.Exit(1)
+	}
 
-	proxyHandler, err := proxy.NewHandler(requests, responses)
+	proxyHandler, err := proxy.NewHandler(store.requests, store.responses, store.messages, store.tunnels, store.pinning, store.rewrites, proxyConfig)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 
 	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: PROXYPORT,
+		Port: settings.Proxy.Port,
 	})
 
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
+	}
+
+	fmt.Printf("Proxy listening at port %d \n", settings.Proxy.Port)
+
+	handler, err := api.NewHandler(store.requests, store.responses, store.messages, store.tunnels, store.pinning, proxyHandler, settings.ApiConfig())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Proxy listening at port %d \n", PROXYPORT)
+	apiServer := startApi(handler, store.tokens, settings.Api)
+
+	serveCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go startApi(requests, responses)
+	proxyServer := newServer(serveCtx)
+
+	if settings.Proxy.SocksPort != 0 {
+		socksListener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			Port: settings.Proxy.SocksPort,
+		})
 
-	for {
-		connection, err := proxyListener.Accept()
 		if err != nil {
 			fmt.Println(err)
-			continue
+			os.Exit(1)
 		}
 
-		go func() {
-			defer connection.Close()
-			err := proxyHandler.Handle(connection)
-			if err != nil {
-				fmt.Println(err)
-			}
-		}()
+		fmt.Printf("SOCKS5 listening at port %d \n", settings.Proxy.SocksPort)
+
+		go proxyServer.serve(socksListener, proxyHandler.HandleSocks)
 	}
 
-}
+	if settings.Proxy.TransparentPort != 0 {
+		transparentListener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			Port: settings.Proxy.TransparentPort,
+		})
 
-func startApi(req repository.RequestSaver, resp repository.ResponseSaver) {
-	router := mux.NewRouter()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Transparent proxy listening at port %d \n", settings.Proxy.TransparentPort)
+
+		go proxyServer.serve(transparentListener, proxyHandler.HandleTransparent)
+	}
+
+	go proxyServer.serve(proxyListener, proxyHandler.Handle)
+
+	<-serveCtx.Done()
+	// A second signal kills the process right away.
+	stop()
+
+	fmt.Println("Shutting down...")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), settings.ShutdownTimeout)
+	defer cancelShutdown()
+
+	apiDone := make(chan error, 1)
+	go func() {
+		apiDone <- apiServer.Shutdown(shutdownCtx)
+	}()
+
+	proxyHandler.Close()
 
-	handler, err := api.NewHandler(req, resp)
+	err = proxyServer.shutdown(shutdownCtx)
 	if err != nil {
 		fmt.Println(err)
-		return
 	}
 
-	router.HandleFunc("/requests", handler.ListRequests)
-	router.HandleFunc("/requests/{id}", handler.GetRequest)
-	router.HandleFunc("/repeat/{id}", handler.RepeatRequest)
-	router.HandleFunc("/scan/{id}", handler.ScanRequest)
-	router.HandleFunc("/requests/{id}/dump", handler.DumpRequest)
+	err = <-apiDone
+	if err != nil {
+		fmt.Println("api:", err)
+	}
+
+	// Requests are saved before their handlers return, so nothing is
+	// pending once the servers are down.
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDisconnect()
+
+	err = store.close(disconnectCtx)
+	if err != nil {
+		fmt.Println(settings.Storage.Backend+":", err)
+	}
+
+	fmt.Println("Stopped")
+}
+
+// startApi serves the API in the background, the returned server is shut
+// down with the proxy.
+func startApi(handler *api.Handler, tokens repository.TokenSaver, apiConfig config.ApiConfig) *http.Server {
+	router := mux.NewRouter()
+
+	address := net.JoinHostPort(apiConfig.Host, strconv.Itoa(apiConfig.Port))
+
+	// Without a token the configuration only allows loopback hosts.
+	auth := api.NewAuth(tokens, apiConfig.AdminToken)
+	if !auth.Enabled() {
+		fmt.Printf("Api authentication is disabled, it is only reachable at %s, set -api-admin-token to enable it\n", address)
+	}
+
+	view := func(next http.HandlerFunc) http.HandlerFunc {
+		return auth.Require(api.RoleViewer, next)
+	}
+	operate := func(next http.HandlerFunc) http.HandlerFunc {
+		return auth.Require(api.RoleOperator, next)
+	}
+	admin := func(next http.HandlerFunc) http.HandlerFunc {
+		return auth.Require(api.RoleAdmin, next)
+	}
+
+	router.HandleFunc("/requests", view(handler.ListRequests))
+	router.HandleFunc("/requests/{id}", view(handler.GetRequest))
+	router.HandleFunc("/repeat/{id}", operate(handler.RepeatRequest))
+	router.HandleFunc("/scan/{id}", operate(handler.ScanRequest))
+	router.HandleFunc("/requests/{id}/dump", view(handler.DumpRequest))
+	router.HandleFunc("/requests/{id}/body", view(handler.GetRequestBody))
+
+	router.HandleFunc("/responses", view(handler.ListResponses))
+	router.HandleFunc("/responses/{id}", view(handler.GetResponse))
+	router.HandleFunc("/responses/{id}/body", view(handler.GetResponseBody))
+	router.HandleFunc("/requests/{id}/response", view(handler.GetRequestResponse))
+
+	router.HandleFunc("/requests/{id}/messages", view(handler.ListRequestMessages))
+	router.HandleFunc("/messages/{id}", view(handler.GetMessage))
+	router.HandleFunc("/messages/{id}/replay", operate(handler.ReplayMessage))
+
+	router.HandleFunc("/intercept/rules", view(handler.GetInterceptRules)).Methods(http.MethodGet)
+	router.HandleFunc("/intercept/rules", operate(handler.SetInterceptRules)).Methods(http.MethodPut)
+	router.HandleFunc("/intercept/queue", view(handler.ListHeld))
+	router.HandleFunc("/intercept/queue/{id}", view(handler.GetHeld))
+	router.HandleFunc("/intercept/queue/{id}/forward", operate(handler.ForwardHeld)).Methods(http.MethodPost)
+	router.HandleFunc("/intercept/queue/{id}/drop", operate(handler.DropHeld)).Methods(http.MethodPost)
+
+	router.HandleFunc("/rewrite/rules", view(handler.GetRewriteRules)).Methods(http.MethodGet)
+	router.HandleFunc("/rewrite/rules", operate(handler.SetRewriteRules)).Methods(http.MethodPut)
+
+	router.HandleFunc("/scope", view(handler.GetScope)).Methods(http.MethodGet)
+	router.HandleFunc("/scope", operate(handler.SetScope)).Methods(http.MethodPut)
 
-	router.HandleFunc("/responses", handler.ListResponses)
-	router.HandleFunc("/responses/{id}", handler.GetResponse)
-	router.HandleFunc("/requests/{id}/response", handler.GetRequestResponse)
+	router.HandleFunc("/scripts", view(handler.ListScripts))
 
-	fmt.Println("Api listening at port 8000...")
+	router.HandleFunc("/tunnels", view(handler.ListTunnels))
+	router.HandleFunc("/pinning", view(handler.ListPinnedHosts))
+
+	router.HandleFunc("/stats/pool", view(handler.GetPoolStats))
+
+	router.HandleFunc("/admin/tokens", admin(auth.ListTokens)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/tokens", admin(auth.CreateToken)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/tokens/{id}", admin(auth.DeleteToken)).Methods(http.MethodDelete)
+
+	fmt.Printf("Api listening at %s...\n", address)
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: router,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
 
-	http.ListenAndServe(":8000", router)
+	return server
 }
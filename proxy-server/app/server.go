@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// server accepts connections on the proxy listeners and keeps track of them,
+// so that shutdown can wait for them and close those still open at the
+// deadline.
+type server struct {
+	ctx         context.Context
+	mutex       sync.Mutex
+	listeners   []net.Listener
+	connections map[net.Conn]struct{}
+	wait        sync.WaitGroup
+}
+
+// newServer returns a server whose handlers get ctx, it is cancelled when
+// the shutdown begins.
+func newServer(ctx context.Context) *server {
+	return &server{
+		ctx:         ctx,
+		connections: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *server) serve(listener net.Listener, handle func(context.Context, net.Conn) error) {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mutex.Unlock()
+
+	for {
+		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.connections[connection] = struct{}{}
+		s.wait.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wait.Done()
+			defer s.forget(connection)
+
+			err := handle(s.ctx, connection)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+}
+
+func (s *server) forget(connection net.Conn) {
+	s.mutex.Lock()
+	delete(s.connections, connection)
+	s.mutex.Unlock()
+
+	connection.Close()
+}
+
+// shutdown stops accepting and waits for the handlers to return. When ctx
+// is done first, the remaining connections are closed and their handlers
+// waited for.
+func (s *server) shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	count := len(s.connections)
+	for connection := range s.connections {
+		connection.Close()
+	}
+	s.mutex.Unlock()
+
+	<-done
+
+	return fmt.Errorf("closed %d connections that did not finish in time", count)
+}
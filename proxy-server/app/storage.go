@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"proxy-server/pkg/config"
+	"proxy-server/pkg/repository"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storage holds the savers of the configured backend.
+type storage struct {
+	requests  repository.RequestSaver
+	responses repository.ResponseSaver
+	messages  repository.MessageSaver
+	tunnels   repository.TunnelSaver
+	pinning   repository.PinningSaver
+	rewrites  repository.RewriteSaver
+	tokens    repository.TokenSaver
+
+	close func(ctx context.Context) error
+}
+
+func openStorage(settings *config.Config) (*storage, error) {
+	bodies, err := diskBodies(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Storage.Backend == config.StorageMemory {
+		maxEntries := settings.Storage.MaxEntries
+		maxBytes := settings.Storage.MaxBytes
+
+		return &storage{
+			requests:  repository.NewMemoryRequestSaver(maxEntries, maxBytes, bodies),
+			responses: repository.NewMemoryResponseSaver(maxEntries, maxBytes, bodies),
+			messages:  repository.NewMemoryMessageSaver(maxEntries, maxBytes),
+			tunnels:   repository.NewMemoryTunnelSaver(maxEntries, maxBytes),
+			pinning:   repository.NewMemoryPinningSaver(),
+			rewrites:  repository.NewMemoryRewriteSaver(),
+			tokens:    repository.NewMemoryTokenSaver(),
+			close:     func(ctx context.Context) error { return nil },
+		}, nil
+	}
+
+	if settings.Storage.Backend == config.StorageSqlite {
+		db, err := repository.OpenSqlite(settings.Storage.SqlitePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &storage{
+			requests:  repository.NewSqliteRequestSaver(db, bodies),
+			responses: repository.NewSqliteResponseSaver(db, bodies),
+			messages:  repository.NewSqliteMessageSaver(db),
+			tunnels:   repository.NewSqliteTunnelSaver(db),
+			pinning:   repository.NewSqlitePinningSaver(db),
+			rewrites:  repository.NewSqliteRewriteSaver(db),
+			tokens:    repository.NewSqliteTokenSaver(db),
+			close:     func(ctx context.Context) error { return db.Close() },
+		}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mongoConnection, err := mongo.Connect(ctx, options.Client().ApplyURI(settings.Mongo.Uri))
+	if err != nil {
+		return nil, err
+	}
+
+	err = mongoConnection.Ping(ctx, nil)
+	if err != nil {
+		mongoConnection.Disconnect(context.Background())
+		return nil, err
+	}
+
+	if bodies == nil && settings.Storage.BodyThreshold > 0 {
+		blobs, err := repository.NewMongoBlobStore(mongoConnection)
+		if err != nil {
+			mongoConnection.Disconnect(context.Background())
+			return nil, err
+		}
+
+		bodies = &repository.BodyStore{Blobs: blobs, Threshold: settings.Storage.BodyThreshold}
+	}
+
+	return &storage{
+		requests:  repository.NewMongoRequestSaver(mongoConnection, bodies),
+		responses: repository.NewMongoResponseSaver(mongoConnection, bodies),
+		messages:  repository.NewMongoMessageSaver(mongoConnection),
+		tunnels:   repository.NewMongoTunnelSaver(mongoConnection),
+		pinning:   repository.NewMongoPinningSaver(mongoConnection),
+		rewrites:  repository.NewMongoRewriteSaver(mongoConnection),
+		tokens:    repository.NewMongoTokenSaver(mongoConnection),
+		close:     mongoConnection.Disconnect,
+	}, nil
+}
+
+// diskBodies returns the store for large bodies when a directory is set for
+// them, nil otherwise.
+func diskBodies(settings *config.Config) (*repository.BodyStore, error) {
+	if settings.Storage.BodyDir == "" || settings.Storage.BodyThreshold == 0 {
+		return nil, nil
+	}
+
+	blobs, err := repository.NewDiskBlobStore(settings.Storage.BodyDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repository.BodyStore{Blobs: blobs, Threshold: settings.Storage.BodyThreshold}, nil
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-server/pkg/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles are ordered, every role may do what the ones before it may.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+const DefaultMaxAuthFailures = 5
+const DefaultAuthFailureWindow = time.Minute
+
+// Auth checks the Bearer tokens of API calls. The admin token from the
+// command line is always valid and creates the other tokens. Without it
+// authentication is off.
+type Auth struct {
+	tokens    repository.TokenSaver
+	adminHash string
+	failures  *failureLimiter
+}
+
+func NewAuth(tokens repository.TokenSaver, adminToken string) *Auth {
+	auth := &Auth{
+		tokens:   tokens,
+		failures: newFailureLimiter(DefaultMaxAuthFailures, DefaultAuthFailureWindow),
+	}
+
+	if adminToken != "" {
+		auth.adminHash = hashToken(adminToken)
+	}
+
+	return auth
+}
+
+func (a *Auth) Enabled() bool {
+	return a.adminHash != ""
+}
+
+// Require wraps next so that it only runs for tokens with at least role.
+func (a *Auth) Require(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next(w, r)
+			return
+		}
+
+		client := clientAddress(r)
+
+		wait := a.failures.blocked(client)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("Too many failed attempts"))
+			return
+		}
+
+		tokenRole, err := a.roleOf(r)
+		if err != nil {
+			a.failures.record(client)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxy-server"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if roleLevels[tokenRole] < roleLevels[role] {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Role " + role + " required"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (a *Auth) roleOf(r *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errors.New("Bearer token required")
+	}
+
+	hash := hashToken(strings.TrimSpace(token))
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminHash)) == 1 {
+		return RoleAdmin, nil
+	}
+
+	value, err := a.tokens.GetByHash(hash)
+	if err != nil {
+		return "", errors.New("Invalid token")
+	}
+
+	return value.Role, nil
+}
+
+type createdToken struct {
+	*repository.Token
+	Secret string `json:"token"`
+}
+
+// CreateToken makes a token with the name and role from the request body.
+// The token is only returned here.
+func (a *Auth) CreateToken(w http.ResponseWriter, r *http.Request) {
+	token := &repository.Token{}
+
+	err := json.NewDecoder(r.Body).Decode(token)
+	if err != nil {
+		HttpError(errors.New("Error parsing token: "+err.Error()), w)
+		return
+	}
+
+	if _, ok := roleLevels[token.Role]; !ok {
+		HttpError(fmt.Errorf("unknown role %q", token.Role), w)
+		return
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	value := hex.EncodeToString(secret)
+	token.Hash = hashToken(value)
+	token.Created = time.Now()
+
+	_, err = a.tokens.Save(token)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(&createdToken{Token: token, Secret: value})
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (a *Auth) ListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := a.tokens.List()
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(tokens)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (a *Auth) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	err := a.tokens.Delete(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// failureLimiter blocks a client address for window once it failed max times
+// within window.
+type failureLimiter struct {
+	mutex    sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string]*failures
+}
+
+type failures struct {
+	count int
+	first time.Time
+}
+
+func newFailureLimiter(max int, window time.Duration) *failureLimiter {
+	return &failureLimiter{
+		max:      max,
+		window:   window,
+		failures: make(map[string]*failures),
+	}
+}
+
+// blocked returns how long client still has to wait, zero when it may try.
+func (l *failureLimiter) blocked(client string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	value, ok := l.failures[client]
+	if !ok || value.count < l.max {
+		return 0
+	}
+
+	wait := time.Until(value.first.Add(l.window))
+	if wait <= 0 {
+		delete(l.failures, client)
+		return 0
+	}
+
+	return wait
+}
+
+func (l *failureLimiter) record(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, value := range l.failures {
+		if now.Sub(value.first) > l.window {
+			delete(l.failures, key)
+		}
+	}
+
+	value, ok := l.failures[client]
+	if !ok {
+		value = &failures{first: now}
+		l.failures[client] = value
+	}
+
+	value.count++
+}
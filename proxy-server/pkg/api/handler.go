@@ -15,8 +15,11 @@ import (
 	"strings"
 	"time"
 
+	"proxy-server/pkg/chain"
 	commandinjection "proxy-server/pkg/command-injection"
+	"proxy-server/pkg/proxy"
 	"proxy-server/pkg/repository"
+	"proxy-server/pkg/websocket"
 
 	"github.com/gorilla/mux"
 )
@@ -24,13 +27,24 @@ import (
 type Handler struct {
 	requests  repository.RequestSaver
 	responses repository.ResponseSaver
+	messages  repository.MessageSaver
+	tunnels   repository.TunnelSaver
+	pinning   repository.PinningSaver
+	proxy     *proxy.Handler
 	client    *http.Client
+	transport *http.Transport
+	config    Config
 }
 
-const DefaultTimeout = time.Second * 10
+// Config holds the timeout of requests the API sends itself, such as repeats
+// and scans, and the CA certificate those trust.
+type Config struct {
+	Timeout time.Duration
+	CaCert  string
+}
 
-func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver) (*Handler, error) {
-	transport, err := getTlsTransport()
+func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver, messages repository.MessageSaver, tunnels repository.TunnelSaver, pinning repository.PinningSaver, proxyHandler *proxy.Handler, config Config) (*Handler, error) {
+	transport, err := getTlsTransport(proxyHandler.Dialer(), config.CaCert)
 	if err != nil {
 		return nil, err
 	}
@@ -38,12 +52,18 @@ func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver) (*Ha
 	return &Handler{
 		requests:  req,
 		responses: resp,
+		messages:  messages,
+		tunnels:   tunnels,
+		pinning:   pinning,
+		proxy:     proxyHandler,
+		transport: transport,
+		config:    config,
 		client: &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 			Transport: transport,
-			Timeout:   DefaultTimeout,
+			Timeout:   config.Timeout,
 		},
 	}, nil
 }
@@ -66,6 +86,7 @@ func (h *Handler) GetRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 const kDefaultListSize = 5
+const kDefaultMessageListSize = 100
 
 func (h *Handler) ListRequests(w http.ResponseWriter, r *http.Request) {
 	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
@@ -89,7 +110,14 @@ func (h *Handler) ListRequests(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RepeatRequest sends a stored request again, with ?raw=true exactly as its
+// client sent it.
 func (h *Handler) RepeatRequest(w http.ResponseWriter, r *http.Request) {
+	if isRaw(r) {
+		h.repeatRawRequest(w, r)
+		return
+	}
+
 	req, err := h.requests.GetEncoded(mux.Vars(r)["id"])
 	if err != nil {
 		HttpError(errors.New("Error getting request: "+err.Error()), w)
@@ -119,7 +147,14 @@ func (h *Handler) RepeatRequest(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// DumpRequest writes a stored request in HTTP/1.1 form, rebuilt from the
+// parsed view or with ?raw=true as its client sent it.
 func (h *Handler) DumpRequest(w http.ResponseWriter, r *http.Request) {
+	if isRaw(r) {
+		h.dumpRawRequest(w, r)
+		return
+	}
+
 	req, err := h.requests.GetEncoded(mux.Vars(r)["id"])
 	if err != nil {
 		HttpError(err, w)
@@ -135,6 +170,17 @@ func (h *Handler) DumpRequest(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// GetRequestBody streams the stored request body as it was sent.
+func (h *Handler) GetRequestBody(w http.ResponseWriter, r *http.Request) {
+	body, err := h.requests.Body(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	writeBody(body, w)
+}
+
 func (h *Handler) ScanRequest(w http.ResponseWriter, r *http.Request) {
 	const semicolonString = ";cat /etc/passwd;"
 	const pipelineString = "|cat /etc/passwd|"
@@ -146,6 +192,12 @@ func (h *Handler) ScanRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.proxy.Scope().ContainsURL(req.URL) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Request is out of scope"))
+		return
+	}
+
 	trySemicolonInjReq, err := commandinjection.TryInjection(req, semicolonString)
 	if err != nil {
 		HttpError(err, w)
@@ -242,6 +294,28 @@ func (h *Handler) GetResponse(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetResponseBody streams the stored response body as it was received.
+func (h *Handler) GetResponseBody(w http.ResponseWriter, r *http.Request) {
+	body, err := h.responses.Body(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	writeBody(body, w)
+}
+
+func writeBody(body io.ReadCloser, w http.ResponseWriter) {
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	_, err := io.Copy(w, body)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (h *Handler) GetRequestResponse(w http.ResponseWriter, r *http.Request) {
 	resp, err := h.responses.GetByRequest(mux.Vars(r)["id"])
 	if err != nil {
@@ -281,8 +355,206 @@ func (h *Handler) ListResponses(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getTlsConfig() (*tls.Config, error) {
-	cert, err := os.ReadFile("https/ca.crt")
+func (h *Handler) ListRequestMessages(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		limit = kDefaultMessageListSize
+	}
+
+	messages, err := h.messages.ListByRequest(mux.Vars(r)["id"], limit)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(messages)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) GetMessage(w http.ResponseWriter, r *http.Request) {
+	message, err := h.messages.Get(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(message)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+type replayResult struct {
+	Sent  *repository.Message `json:"sent"`
+	Reply *repository.Message `json:"reply"`
+}
+
+// ReplayMessage opens a new WebSocket connection with the handshake of the
+// request that carried the message, sends the message to the server and
+// returns the first message the server answers with.
+func (h *Handler) ReplayMessage(w http.ResponseWriter, r *http.Request) {
+	message, err := h.messages.Get(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	req, err := h.requests.GetEncoded(message.RequestId.Hex())
+	if err != nil {
+		HttpError(errors.New("Error getting request: "+err.Error()), w)
+		return
+	}
+
+	cfg, err := getTlsConfig(h.config.CaCert)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	conn, _, err := websocket.Dial(req, h.proxy.Dialer(), cfg, h.config.Timeout)
+	if err != nil {
+		HttpError(errors.New("Error opening websocket: "+err.Error()), w)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.WriteFrame(&websocket.Frame{
+		Fin:     true,
+		Opcode:  byte(message.Opcode),
+		Payload: []byte(message.Payload),
+	})
+	if err != nil {
+		HttpError(errors.New("Error sending message: "+err.Error()), w)
+		return
+	}
+
+	result := replayResult{Sent: message}
+
+	conn.SetReadDeadline(time.Now().Add(h.config.Timeout))
+	reply, err := readMessage(conn)
+	if err == nil {
+		result.Reply = reply
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(result)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func readMessage(conn *websocket.Conn) (*repository.Message, error) {
+	var reply *repository.Message
+	var payload []byte
+
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if frame.Opcode == websocket.OpPing || frame.Opcode == websocket.OpPong {
+			continue
+		}
+
+		if frame.Opcode != websocket.OpContinuation {
+			reply = &repository.Message{
+				Direction: repository.DirectionToClient,
+				Opcode:    int(frame.Opcode),
+				Time:      time.Now(),
+			}
+		}
+
+		payload = append(payload, frame.Payload...)
+
+		if frame.Fin && reply != nil {
+			reply.Payload = string(payload)
+			return reply, nil
+		}
+	}
+}
+
+func (h *Handler) ListTunnels(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		limit = kDefaultListSize
+	}
+
+	tunnels, err := h.tunnels.List(r.URL.Query().Get("host"), limit)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(tunnels)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) ListPinnedHosts(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		limit = kDefaultMessageListSize
+	}
+
+	hosts, err := h.pinning.List(limit)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(hosts)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) ListScripts(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.Scripts())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) GetPoolStats(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.PoolStats())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func getTlsConfig(caCert string) (*tls.Config, error) {
+	cert, err := os.ReadFile(caCert)
 	if err != nil {
 		return nil, err
 	}
@@ -299,13 +571,14 @@ func getTlsConfig() (*tls.Config, error) {
 	}, nil
 }
 
-func getTlsTransport() (*http.Transport, error) {
-	cfg, err := getTlsConfig()
+func getTlsTransport(dialer *chain.Dialer, caCert string) (*http.Transport, error) {
+	cfg, err := getTlsConfig(caCert)
 	if err != nil {
 		return nil, err
 	}
 
 	return &http.Transport{
+		DialContext:         dialer.DialContext,
 		TLSHandshakeTimeout: time.Second * 5,
 		TLSClientConfig:     cfg,
 	}, nil
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-server/pkg/proxy"
+	"proxy-server/pkg/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// writeCertificates creates a CA and a leaf key in a temporary directory.
+func writeCertificates(t *testing.T) proxy.CertificateConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy-server test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := proxy.CertificateConfig{
+		CaCert:  filepath.Join(dir, "ca.crt"),
+		CaKey:   filepath.Join(dir, "ca.key"),
+		LeafKey: filepath.Join(dir, "cert.key"),
+		Dir:     filepath.Join(dir, "certs"),
+	}
+
+	writePem(t, config.CaCert, "CERTIFICATE", der)
+	writePem(t, config.CaKey, "EC PRIVATE KEY", marshalKey(t, caKey))
+	writePem(t, config.LeafKey, "EC PRIVATE KEY", marshalKey(t, leafKey))
+
+	err = os.Mkdir(config.Dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func writePem(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestApi serves the API of a proxy that records into the memory backend.
+func newTestApi(t *testing.T) (*httptest.Server, repository.RequestSaver, repository.ResponseSaver) {
+	t.Helper()
+
+	certificates := writeCertificates(t)
+
+	requests := repository.NewMemoryRequestSaver(100, 1<<20, nil)
+	responses := repository.NewMemoryResponseSaver(100, 1<<20, nil)
+	messages := repository.NewMemoryMessageSaver(100, 1<<20)
+	tunnels := repository.NewMemoryTunnelSaver(100, 1<<20)
+	pinning := repository.NewMemoryPinningSaver()
+
+	proxyHandler, err := proxy.NewHandler(requests, responses, messages, tunnels, pinning, repository.NewMemoryRewriteSaver(), proxy.Config{
+		Certificates: certificates,
+		Timeout:      5 * time.Second,
+		IdleTimeout:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proxyHandler.Close)
+
+	handler, err := NewHandler(requests, responses, messages, tunnels, pinning, proxyHandler, Config{
+		Timeout: 5 * time.Second,
+		CaCert:  certificates.CaCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/requests", handler.ListRequests)
+	router.HandleFunc("/requests/{id}", handler.GetRequest)
+	router.HandleFunc("/repeat/{id}", handler.RepeatRequest)
+	router.HandleFunc("/requests/{id}/dump", handler.DumpRequest)
+	router.HandleFunc("/requests/{id}/response", handler.GetRequestResponse)
+	router.HandleFunc("/rewrite/rules", handler.GetRewriteRules).Methods(http.MethodGet)
+	router.HandleFunc("/rewrite/rules", handler.SetRewriteRules).Methods(http.MethodPut)
+	router.HandleFunc("/scope", handler.GetScope).Methods(http.MethodGet)
+	router.HandleFunc("/scope", handler.SetScope).Methods(http.MethodPut)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return server, requests, responses
+}
+
+// saveRequest records a request to url the way the proxy does, with the raw
+// head the client sent.
+func saveRequest(t *testing.T, requests repository.RequestSaver, url, rawHead string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("X-Test", "1")
+
+	id, err := requests.Save(repository.WithRawHead(req, []byte(rawHead)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestListAndGetRequests(t *testing.T) {
+	server, requests, responses := newTestApi(t)
+
+	first := saveRequest(t, requests, "http://example.com/first", "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	second := saveRequest(t, requests, "http://example.com/second", "GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	_, err := responses.Save(first, &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := get(t, server.URL+"/requests?limit=1")
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+
+	list := make([]map[string]interface{}, 0)
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0]["id"] != second {
+		t.Errorf("listed %v", list)
+	}
+
+	code, body = get(t, server.URL+"/requests/"+first)
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+
+	value := make(map[string]interface{})
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value["path"] != "/first" || value["raw_head"] != "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n" {
+		t.Errorf("got %v", value)
+	}
+
+	code, body = get(t, server.URL+"/requests/"+first+"/response")
+	if code != http.StatusOK || !strings.Contains(string(body), `"code":204`) {
+		t.Errorf("got %d: %s", code, body)
+	}
+}
+
+func TestRawRequestLeavesOutProxyHeaders(t *testing.T) {
+	server, requests, _ := newTestApi(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Authorization", r.Header.Get("Proxy-Authorization"))
+		w.Header().Set("X-Test", r.Header.Get("X-Test"))
+	}))
+	defer origin.Close()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	id := saveRequest(t, requests, origin.URL+"/", "GET / HTTP/1.1\r\nHost: "+host+"\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\nX-Test: 1\r\n\r\n")
+
+	code, body := get(t, server.URL+"/requests/"+id)
+	if code != http.StatusOK || strings.Contains(string(body), "Proxy-Authorization") {
+		t.Errorf("got %d: %s", code, body)
+	}
+
+	resp, err := http.Get(server.URL + "/repeat/" + id + "?raw=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Test") != "1" {
+		t.Fatalf("repeat got %d", resp.StatusCode)
+	}
+
+	if resp.Header.Get("X-Proxy-Authorization") != "" {
+		t.Error("proxy credentials were sent to the origin")
+	}
+}
+
+func TestSetRewriteRules(t *testing.T) {
+	server, _, _ := newTestApi(t)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/rewrite/rules", strings.NewReader(`[{"location":"request_header","match":"a","replace":"b"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	rules := make([]*repository.RewriteRule, 0)
+	err = json.NewDecoder(resp.Body).Decode(&rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 1 || rules[0].Id.IsZero() || rules[0].Replace != "b" {
+		t.Errorf("got %+v", rules)
+	}
+
+	req, err = http.NewRequest(http.MethodPut, server.URL+"/rewrite/rules", strings.NewReader(`[{"location":"nowhere"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		t.Error("invalid rule was accepted")
+	}
+
+	code, body := get(t, server.URL+"/rewrite/rules")
+	if code != http.StatusOK || !strings.Contains(string(body), `"replace":"b"`) {
+		t.Errorf("got %d: %s", code, body)
+	}
+}
+
+func TestSetScopeRejectsEmptyRules(t *testing.T) {
+	server, _, _ := newTestApi(t)
+
+	for _, body := range []string{`{"include":[null]}`, `{"exclude":[{"host":"a.com"},null]}`} {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/scope", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%s was accepted", body)
+		}
+	}
+
+	code, body := get(t, server.URL+"/scope")
+	if code != http.StatusOK || !strings.Contains(string(body), `"include":[]`) {
+		t.Errorf("got %d: %s", code, body)
+	}
+}
+
+func TestRawRequestChecksBodyLength(t *testing.T) {
+	server, requests, _ := newTestApi(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	rawHead := "POST / HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: %d\r\n\r\n"
+
+	save := func(length int, body string) string {
+		req := httptest.NewRequest(http.MethodPost, origin.URL+"/", strings.NewReader(body))
+
+		id, err := requests.Save(repository.WithRawHead(req, []byte(fmt.Sprintf(rawHead, length))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return id
+	}
+
+	matching := save(5, "hello")
+	edited := save(10, "hello")
+
+	code, body := get(t, server.URL+"/requests/"+matching+"/dump?raw=true")
+	if code != http.StatusOK || string(body) != fmt.Sprintf(rawHead, 5)+"hello" {
+		t.Errorf("dump got %d: %q", code, body)
+	}
+
+	code, body = get(t, server.URL+"/repeat/"+matching+"?raw=true")
+	if code != http.StatusOK || string(body) != "hello" {
+		t.Errorf("repeat got %d: %q", code, body)
+	}
+
+	for _, path := range []string{"/requests/" + edited + "/dump?raw=true", "/repeat/" + edited + "?raw=true"} {
+		code, body = get(t, server.URL+path)
+		if code == http.StatusOK || !strings.Contains(string(body), "announces 10") {
+			t.Errorf("%s got %d: %q", path, code, body)
+		}
+	}
+}
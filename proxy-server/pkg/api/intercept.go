@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"proxy-server/pkg/intercept"
+
+	"github.com/gorilla/mux"
+)
+
+func (h *Handler) GetInterceptRules(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.Interceptor().Rules())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+// SetInterceptRules replaces the rule set. An empty list turns interception
+// off.
+func (h *Handler) SetInterceptRules(w http.ResponseWriter, r *http.Request) {
+	rules := make([]*intercept.Rule, 0)
+
+	err := json.NewDecoder(r.Body).Decode(&rules)
+	if err != nil {
+		HttpError(errors.New("Error parsing rules: "+err.Error()), w)
+		return
+	}
+
+	err = h.proxy.Interceptor().SetRules(rules)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	h.GetInterceptRules(w, r)
+}
+
+func (h *Handler) ListHeld(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.Interceptor().List())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) GetHeld(w http.ResponseWriter, r *http.Request) {
+	held, err := h.proxy.Interceptor().Get(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err = encoder.Encode(held)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+// ForwardHeld releases a held message. The request body may carry an
+// intercept.Edit with the changes to apply first.
+func (h *Handler) ForwardHeld(w http.ResponseWriter, r *http.Request) {
+	decision := &intercept.Decision{Action: intercept.ActionForward}
+
+	err := json.NewDecoder(r.Body).Decode(&decision.Edit)
+	if err != nil && !errors.Is(err, io.EOF) {
+		HttpError(errors.New("Error parsing edit: "+err.Error()), w)
+		return
+	}
+
+	err = h.proxy.Interceptor().Decide(mux.Vars(r)["id"], decision)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) DropHeld(w http.ResponseWriter, r *http.Request) {
+	err := h.proxy.Interceptor().Decide(mux.Vars(r)["id"], &intercept.Decision{Action: intercept.ActionDrop})
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
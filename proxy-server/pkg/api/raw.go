@@ -0,0 +1,208 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"proxy-server/pkg/repository"
+
+	"github.com/gorilla/mux"
+)
+
+func isRaw(r *http.Request) bool {
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	return raw
+}
+
+// rawRequest is a stored request as it is replayed: its head as received,
+// without Proxy-* headers, and its stored body.
+type rawRequest struct {
+	*repository.Request
+	head    []byte
+	body    []byte
+	chunked bool
+}
+
+// getRawRequest returns a stored request that has its head as received, and
+// its body. The body has to fit the framing of the head, a truncated or
+// changed one would leave the origin waiting for the rest or reading the
+// leftover as the next request.
+func (h *Handler) getRawRequest(id string) (*rawRequest, error) {
+	value, err := h.requests.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value.RawHead) == 0 {
+		return nil, errors.New("request has no raw head, it came over HTTP/2, its head was over 64KB or it was recorded before heads were kept")
+	}
+
+	if value.Truncated {
+		return nil, errors.New("request body was truncated when it was recorded")
+	}
+
+	// Proxy-* headers of heads recorded before they were left out are
+	// dropped, they never reach the origin.
+	rawHead := repository.StripProxyHeaders(value.RawHead)
+
+	head, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(rawHead)))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing raw head: %v", err)
+	}
+
+	body, err := h.requests.Body(id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	chunked := len(head.TransferEncoding) != 0
+	if !chunked && int64(len(payload)) != head.ContentLength {
+		return nil, fmt.Errorf("stored body has %d bytes, the raw head announces %d", len(payload), head.ContentLength)
+	}
+
+	return &rawRequest{
+		Request: value,
+		head:    rawHead,
+		body:    payload,
+		chunked: chunked,
+	}, nil
+}
+
+// writeRawRequest writes the head and the body, chunked again when the head
+// says the body was.
+func writeRawRequest(w io.Writer, raw *rawRequest) error {
+	_, err := w.Write(raw.head)
+	if err != nil {
+		return err
+	}
+
+	if !raw.chunked {
+		_, err = w.Write(raw.body)
+		return err
+	}
+
+	chunked := httputil.NewChunkedWriter(w)
+
+	_, err = chunked.Write(raw.body)
+	if err == nil {
+		err = chunked.Close()
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\r\n")
+	}
+
+	return err
+}
+
+func (h *Handler) dumpRawRequest(w http.ResponseWriter, r *http.Request) {
+	raw, err := h.getRawRequest(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	dump := new(bytes.Buffer)
+
+	err = writeRawRequest(dump, raw)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	w.Write(dump.Bytes())
+}
+
+func (h *Handler) repeatRawRequest(w http.ResponseWriter, r *http.Request) {
+	raw, err := h.getRawRequest(mux.Vars(r)["id"])
+	if err != nil {
+		HttpError(errors.New("Error getting request: "+err.Error()), w)
+		return
+	}
+
+	conn, err := h.dialRaw(raw.Scheme, raw.Host)
+	if err != nil {
+		HttpError(errors.New("Error resending request: "+err.Error()), w)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(h.config.Timeout))
+
+	err = writeRawRequest(conn, raw)
+	if err != nil {
+		HttpError(errors.New("Error resending request: "+err.Error()), w)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: raw.Method})
+	if err != nil {
+		HttpError(errors.New("Error resending request: "+err.Error()), w)
+		return
+	}
+	defer resp.Body.Close()
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		HttpError(errors.New("Error resending request: "+err.Error()), w)
+		return
+	}
+
+	for key, values := range resp.Header {
+		for _, elem := range values {
+			w.Header().Add(key, elem)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	w.Write(bytes)
+}
+
+// dialRaw connects to the origin of a stored request the way the repeat
+// client does, through the upstream chain and over TLS for https.
+func (h *Handler) dialRaw(scheme, host string) (net.Conn, error) {
+	address := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(host, port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	conn, err := h.transport.DialContext(ctx, "tcp", address)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+
+	cfg := h.transport.TLSClientConfig.Clone()
+	cfg.ServerName, _, _ = net.SplitHostPort(address)
+
+	tlsConn := tls.Client(conn, cfg)
+
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
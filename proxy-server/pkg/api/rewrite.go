@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"proxy-server/pkg/repository"
+)
+
+func (h *Handler) GetRewriteRules(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.RewriteRules())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+// SetRewriteRules replaces the ordered match-and-replace rules.
+func (h *Handler) SetRewriteRules(w http.ResponseWriter, r *http.Request) {
+	rules := make([]*repository.RewriteRule, 0)
+
+	err := json.NewDecoder(r.Body).Decode(&rules)
+	if err != nil {
+		HttpError(errors.New("Error parsing rules: "+err.Error()), w)
+		return
+	}
+
+	err = h.proxy.SetRewriteRules(rules)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	h.GetRewriteRules(w, r)
+}
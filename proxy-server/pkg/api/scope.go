@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"proxy-server/pkg/scope"
+)
+
+func (h *Handler) GetScope(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(h.proxy.Scope().Get())
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+}
+
+func (h *Handler) SetScope(w http.ResponseWriter, r *http.Request) {
+	config := scope.Config{}
+
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		HttpError(errors.New("Error parsing scope: "+err.Error()), w)
+		return
+	}
+
+	err = h.proxy.Scope().Set(config)
+	if err != nil {
+		HttpError(err, w)
+		return
+	}
+
+	h.GetScope(w, r)
+}
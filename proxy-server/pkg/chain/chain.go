@@ -0,0 +1,166 @@
+package chain
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"proxy-server/pkg/hostmatch"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// Config describes an upstream proxy to forward through. URL is either
+// http://[user:pass@]host:port, which tunnels every connection with CONNECT,
+// or socks5://[user:pass@]host:port. When Include is empty every host goes
+// through the chain, hosts matching Exclude always go direct.
+type Config struct {
+	URL     string
+	Include []string
+	Exclude []string
+}
+
+// Dialer opens connections either directly or through the configured
+// upstream proxy depending on the destination host.
+type Dialer struct {
+	config  Config
+	proxy   *url.URL
+	direct  *net.Dialer
+	socks   netproxy.ContextDialer
+	timeout time.Duration
+}
+
+func NewDialer(config Config, timeout time.Duration) (*Dialer, error) {
+	dialer := &Dialer{
+		config:  config,
+		direct:  &net.Dialer{Timeout: timeout},
+		timeout: timeout,
+	}
+
+	if config.URL == "" {
+		return dialer, nil
+	}
+
+	proxyUrl, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("bad upstream proxy: %v", err)
+	}
+
+	switch proxyUrl.Scheme {
+	case "http":
+	case "socks5", "socks5h":
+		var auth *netproxy.Auth
+		if proxyUrl.User != nil {
+			password, _ := proxyUrl.User.Password()
+			auth = &netproxy.Auth{User: proxyUrl.User.Username(), Password: password}
+		}
+
+		socks, err := netproxy.SOCKS5("tcp", proxyUrl.Host, auth, dialer.direct)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream proxy: %v", err)
+		}
+
+		dialer.socks = socks.(netproxy.ContextDialer)
+	default:
+		return nil, fmt.Errorf("bad upstream proxy: unsupported scheme %q", proxyUrl.Scheme)
+	}
+
+	dialer.proxy = proxyUrl
+
+	return dialer, nil
+}
+
+// Timeout bounds connecting to a destination, including the handshake with
+// the upstream proxy.
+func (d *Dialer) Timeout() time.Duration {
+	return d.timeout
+}
+
+// Chained reports whether connections to host go through the upstream proxy.
+func (d *Dialer) Chained(host string) bool {
+	if d.proxy == nil {
+		return false
+	}
+
+	if hostmatch.MatchAny(d.config.Exclude, host) {
+		return false
+	}
+
+	return len(d.config.Include) == 0 || hostmatch.MatchAny(d.config.Include, host)
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Chained(host) {
+		return d.direct.DialContext(ctx, network, address)
+	}
+
+	if d.socks != nil {
+		return d.socks.DialContext(ctx, network, address)
+	}
+
+	return d.connect(ctx, address)
+}
+
+// connect opens a tunnel to address through an HTTP proxy.
+func (d *Dialer) connect(ctx context.Context, address string) (net.Conn, error) {
+	connection, err := d.direct.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	connection.SetDeadline(time.Now().Add(d.timeout))
+	defer connection.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := d.proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	err = req.Write(connection)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(connection)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	// The body of a successful CONNECT response is the tunnel itself, so
+	// it is not read or closed here.
+	if resp.StatusCode != http.StatusOK {
+		connection.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	if reader.Buffered() != 0 {
+		connection.Close()
+		return nil, fmt.Errorf("upstream proxy sent data before the tunnel to %s was ready", address)
+	}
+
+	return connection, nil
+}
@@ -0,0 +1,422 @@
+// Package config loads the settings of the proxy server. Every setting has a
+// default that is overridden, from lowest to highest precedence, by the YAML
+// file given with -config or PROXY_SERVER_CONFIG, by an environment variable
+// and by a command-line flag. The variable of a flag is its name in upper
+// case with dashes turned into underscores and the PROXY_SERVER_ prefix, so
+// -mongo-uri becomes PROXY_SERVER_MONGO_URI.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"proxy-server/pkg/api"
+	"proxy-server/pkg/chain"
+	"proxy-server/pkg/intercept"
+	"proxy-server/pkg/proxy"
+	"proxy-server/pkg/repository"
+	"proxy-server/pkg/rewrite"
+	"proxy-server/pkg/scope"
+	"proxy-server/pkg/script"
+
+	"gopkg.in/yaml.v3"
+)
+
+const EnvPrefix = "PROXY_SERVER_"
+
+const DefaultTimeout = time.Second * 10
+const DefaultIdleTimeout = time.Second * 60
+const DefaultShutdownTimeout = time.Second * 30
+
+// Storage backends.
+const (
+	StorageMongo  = "mongo"
+	StorageMemory = "memory"
+	StorageSqlite = "sqlite"
+)
+
+type Config struct {
+	Storage      StorageConfig      `yaml:"storage"`
+	Mongo        MongoConfig        `yaml:"mongo"`
+	Proxy        ProxyConfig        `yaml:"proxy"`
+	Api          ApiConfig          `yaml:"api"`
+	Certificates CertificatesConfig `yaml:"certificates"`
+
+	// ShutdownTimeout is how long connections may take to finish after
+	// SIGINT or SIGTERM before they are closed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// StorageConfig selects where traffic is recorded. The memory backend keeps
+// MaxEntries of each kind of record, no more than MaxBytes of each, and loses
+// them on restart, the sqlite one keeps a project in the single file
+// SqlitePath.
+//
+// Bodies larger than BodyThreshold are stored once per content in the
+// directory BodyDir, or in GridFS when it is empty and the backend is mongo,
+// the other backends then keep them inline. A zero BodyThreshold keeps all
+// bodies inline.
+type StorageConfig struct {
+	Backend    string `yaml:"backend"`
+	MaxEntries int    `yaml:"max_entries"`
+	MaxBytes   int64  `yaml:"max_bytes"`
+	SqlitePath string `yaml:"sqlite_path"`
+
+	BodyThreshold int64  `yaml:"body_threshold"`
+	BodyDir       string `yaml:"body_dir"`
+}
+
+type MongoConfig struct {
+	Uri string `yaml:"uri"`
+}
+
+type ProxyConfig struct {
+	Port            int           `yaml:"port"`
+	SocksPort       int           `yaml:"socks_port"`
+	TransparentPort int           `yaml:"transparent_port"`
+	Timeout         time.Duration `yaml:"timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+
+	Users         map[string]string `yaml:"users"`
+	AllowedIps    []string          `yaml:"allowed_ips"`
+	SocksUser     string            `yaml:"socks_user"`
+	SocksPassword string            `yaml:"socks_password"`
+
+	PoolMaxIdle     int           `yaml:"pool_max_idle"`
+	PoolIdleTimeout time.Duration `yaml:"pool_idle_timeout"`
+	MaxCapturedSize int64         `yaml:"max_captured_size"`
+	MaxRewriteSize  int64         `yaml:"max_rewrite_size"`
+	ScriptsDir      string        `yaml:"scripts_dir"`
+
+	UpstreamProxy   string   `yaml:"upstream_proxy"`
+	UpstreamInclude []string `yaml:"upstream_include"`
+	UpstreamExclude []string `yaml:"upstream_exclude"`
+
+	PassthroughHosts         []string `yaml:"passthrough_hosts"`
+	PassthroughPorts         []int    `yaml:"passthrough_ports"`
+	PassthroughAfterFailures int      `yaml:"passthrough_after_failures"`
+
+	InterceptTimeout time.Duration `yaml:"intercept_timeout"`
+	InterceptDefault string        `yaml:"intercept_default"`
+
+	ScopeInclude []string `yaml:"scope_include"`
+	ScopeExclude []string `yaml:"scope_exclude"`
+	ScopeOut     string   `yaml:"scope_out"`
+}
+
+// ApiConfig places the API on Host and Port. Without AdminToken the API is
+// open, so Host must then be a loopback address.
+type ApiConfig struct {
+	Host       string        `yaml:"host"`
+	Port       int           `yaml:"port"`
+	AdminToken string        `yaml:"admin_token"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+type CertificatesConfig struct {
+	CaCert    string `yaml:"ca_cert"`
+	CaKey     string `yaml:"ca_key"`
+	LeafKey   string `yaml:"leaf_key"`
+	Dir       string `yaml:"dir"`
+	MaxCached int    `yaml:"max_cached"`
+}
+
+func Default() *Config {
+	return &Config{
+		Storage: StorageConfig{
+			Backend:    StorageMongo,
+			MaxEntries: repository.DefaultMemoryMaxEntries,
+			MaxBytes:   repository.DefaultMemoryMaxBytes,
+			SqlitePath: "project.db",
+
+			BodyThreshold: repository.DefaultBodyThreshold,
+		},
+		Mongo: MongoConfig{
+			Uri: "mongodb://localhost:27017",
+		},
+		Proxy: ProxyConfig{
+			Port:                     8080,
+			Timeout:                  DefaultTimeout,
+			IdleTimeout:              DefaultIdleTimeout,
+			PoolMaxIdle:              proxy.DefaultMaxIdlePerHost,
+			PoolIdleTimeout:          proxy.DefaultPoolIdleTimeout,
+			MaxCapturedSize:          proxy.DefaultMaxCapturedSize,
+			MaxRewriteSize:           rewrite.DefaultMaxBodySize,
+			ScriptsDir:               script.DefaultDir,
+			PassthroughAfterFailures: 3,
+			InterceptTimeout:         intercept.DefaultTimeout,
+			InterceptDefault:         intercept.ActionForward,
+			ScopeOut:                 scope.OutOfScopeSkip,
+		},
+		Api: ApiConfig{
+			Host:    "127.0.0.1",
+			Port:    8000,
+			Timeout: DefaultTimeout,
+		},
+		Certificates: CertificatesConfig{
+			CaCert:    "https/ca.crt",
+			CaKey:     "https/ca.key",
+			LeafKey:   "https/cert.key",
+			Dir:       "certs",
+			MaxCached: proxy.DefaultMaxCertificates,
+		},
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// Load builds the configuration from args, the environment and the config
+// file and validates it. flag.ErrHelp is returned when usage was requested.
+func Load(args []string) (*Config, error) {
+	config := Default()
+	options := config.options()
+
+	flags := flag.NewFlagSet("proxy-server", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv(EnvPrefix+"CONFIG"), "YAML configuration file, overridden by environment variables and flags")
+
+	given := make(map[string]string)
+	for _, opt := range options {
+		flags.Var(&flagValue{option: opt, given: given}, opt.name, opt.usage)
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	if *path != "" {
+		err = config.loadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range options {
+		value, ok := os.LookupEnv(opt.env())
+		if !ok {
+			continue
+		}
+
+		err = opt.set(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", opt.env(), err)
+		}
+	}
+
+	for _, opt := range options {
+		value, ok := given[opt.name]
+		if !ok {
+			continue
+		}
+
+		err = opt.set(value)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %v", opt.name, err)
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every bad value at once.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	switch c.Storage.Backend {
+	case StorageMongo:
+		check(strings.HasPrefix(c.Mongo.Uri, "mongodb://") || strings.HasPrefix(c.Mongo.Uri, "mongodb+srv://"), "mongo uri %q is not a mongodb:// URI", c.Mongo.Uri)
+	case StorageMemory:
+		check(c.Storage.MaxEntries > 0, "memory max entries must be positive")
+		check(c.Storage.MaxBytes > 0, "memory max bytes must be positive")
+	case StorageSqlite:
+		check(c.Storage.SqlitePath != "", "sqlite path is empty")
+	default:
+		check(false, "storage %q is not mongo, memory or sqlite", c.Storage.Backend)
+	}
+
+	check(c.Storage.BodyThreshold >= 0, "body threshold must not be negative")
+
+	check(validPort(c.Proxy.Port), "proxy port %d is out of range", c.Proxy.Port)
+	check(validPort(c.Api.Port), "api port %d is out of range", c.Api.Port)
+	check(c.Api.AdminToken != "" || isLoopback(c.Api.Host), "api host %q is reachable from other machines, set an api admin token or listen on loopback", c.Api.Host)
+	check(c.Proxy.SocksPort == 0 || validPort(c.Proxy.SocksPort), "socks port %d is out of range", c.Proxy.SocksPort)
+	check(c.Proxy.TransparentPort == 0 || validPort(c.Proxy.TransparentPort), "transparent port %d is out of range", c.Proxy.TransparentPort)
+
+	ports := make(map[int]string)
+	for name, port := range map[string]int{"proxy": c.Proxy.Port, "api": c.Api.Port, "socks": c.Proxy.SocksPort, "transparent": c.Proxy.TransparentPort} {
+		if port == 0 {
+			continue
+		}
+		if other, ok := ports[port]; ok {
+			check(false, "%s and %s both use port %d", other, name, port)
+		}
+		ports[port] = name
+	}
+
+	check(c.Proxy.Timeout > 0, "proxy timeout must be positive")
+	check(c.Proxy.IdleTimeout > 0, "proxy idle timeout must be positive")
+	check(c.Api.Timeout > 0, "api timeout must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown timeout must be positive")
+	check(c.Proxy.PoolIdleTimeout > 0, "pool idle timeout must be positive")
+	check(c.Proxy.InterceptTimeout > 0, "intercept timeout must be positive")
+	check(c.Proxy.PoolMaxIdle >= 0, "pool max idle must not be negative")
+	check(c.Proxy.MaxCapturedSize >= 0, "max captured size must not be negative")
+	check(c.Proxy.MaxRewriteSize > 0, "max rewrite size must be positive")
+	check(c.Certificates.MaxCached > 0, "certificates max cached must be positive")
+	check(c.Proxy.PassthroughAfterFailures >= 0, "passthrough after failures must not be negative")
+
+	for _, port := range c.Proxy.PassthroughPorts {
+		check(validPort(port), "passthrough port %d is out of range", port)
+	}
+
+	for user := range c.Proxy.Users {
+		check(user != "" && !strings.Contains(user, ":"), "proxy user %q is not a valid name", user)
+	}
+
+	check(c.Proxy.InterceptDefault == intercept.ActionForward || c.Proxy.InterceptDefault == intercept.ActionDrop, "intercept default %q is neither forward nor drop", c.Proxy.InterceptDefault)
+	check(c.Proxy.ScopeOut == scope.OutOfScopeSkip || c.Proxy.ScopeOut == scope.OutOfScopeTag, "scope out %q is neither skip nor tag", c.Proxy.ScopeOut)
+
+	for _, rule := range append(append([]string{}, c.Proxy.ScopeInclude...), c.Proxy.ScopeExclude...) {
+		_, err := scope.ParseRule(rule)
+		check(err == nil, "%v", err)
+	}
+
+	if c.Proxy.UpstreamProxy != "" {
+		upstream, err := url.Parse(c.Proxy.UpstreamProxy)
+		check(err == nil && upstream.Host != "" && (upstream.Scheme == "http" || upstream.Scheme == "socks5"), "upstream proxy %q is not an http:// or socks5:// URL", c.Proxy.UpstreamProxy)
+	}
+
+	for _, path := range []string{c.Certificates.CaCert, c.Certificates.CaKey, c.Certificates.LeafKey} {
+		info, err := os.Stat(path)
+		check(err == nil && !info.IsDir(), "certificate file %q is not readable", path)
+	}
+
+	info, err := os.Stat(c.Certificates.Dir)
+	check(err == nil && info.IsDir(), "certificate directory %q does not exist", c.Certificates.Dir)
+
+	if len(problems) != 0 {
+		return errors.New("bad configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ProxyConfig is the part of the configuration proxy.NewHandler takes.
+func (c *Config) ProxyConfig() (proxy.Config, error) {
+	include, err := scope.ParseRules(c.Proxy.ScopeInclude)
+	if err != nil {
+		return proxy.Config{}, err
+	}
+
+	exclude, err := scope.ParseRules(c.Proxy.ScopeExclude)
+	if err != nil {
+		return proxy.Config{}, err
+	}
+
+	return proxy.Config{
+		Pool: proxy.PoolConfig{
+			MaxIdlePerHost: c.Proxy.PoolMaxIdle,
+			IdleTimeout:    c.Proxy.PoolIdleTimeout,
+		},
+		MaxCapturedSize: c.Proxy.MaxCapturedSize,
+		Socks: proxy.SocksConfig{
+			Username: c.Proxy.SocksUser,
+			Password: c.Proxy.SocksPassword,
+		},
+		Chain: chain.Config{
+			URL:     c.Proxy.UpstreamProxy,
+			Include: c.Proxy.UpstreamInclude,
+			Exclude: c.Proxy.UpstreamExclude,
+		},
+		Passthrough: proxy.PassthroughConfig{
+			Hosts:     c.Proxy.PassthroughHosts,
+			Ports:     c.Proxy.PassthroughPorts,
+			AutoAfter: c.Proxy.PassthroughAfterFailures,
+		},
+		Intercept: intercept.Config{
+			Timeout:       c.Proxy.InterceptTimeout,
+			DefaultAction: c.Proxy.InterceptDefault,
+		},
+		MaxRewriteSize: c.Proxy.MaxRewriteSize,
+		Scripts: script.Config{
+			Dir:         c.Proxy.ScriptsDir,
+			MaxBodySize: c.Proxy.MaxRewriteSize,
+		},
+		Scope: scope.Config{
+			Include:    include,
+			Exclude:    exclude,
+			OutOfScope: c.Proxy.ScopeOut,
+		},
+		Auth: proxy.AuthConfig{
+			Users:      c.Proxy.Users,
+			AllowedIps: c.Proxy.AllowedIps,
+		},
+		Certificates: proxy.CertificateConfig{
+			CaCert:    c.Certificates.CaCert,
+			CaKey:     c.Certificates.CaKey,
+			LeafKey:   c.Certificates.LeafKey,
+			Dir:       c.Certificates.Dir,
+			MaxCached: c.Certificates.MaxCached,
+		},
+		Timeout:     c.Proxy.Timeout,
+		IdleTimeout: c.Proxy.IdleTimeout,
+	}, nil
+}
+
+// ApiConfig is the part of the configuration api.NewHandler takes.
+func (c *Config) ApiConfig() api.Config {
+	return api.Config{
+		Timeout: c.Api.Timeout,
+		CaCert:  c.Certificates.CaCert,
+	}
+}
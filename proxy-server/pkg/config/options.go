@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-server/pkg/hostmatch"
+)
+
+// option ties a flag and its environment variable to a field of Config.
+// Lists are comma separated, users are user:password pairs.
+type option struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+func (c *Config) options() []*option {
+	return []*option{
+		{"storage", "where traffic is recorded, mongo, memory or sqlite", &c.Storage.Backend},
+		{"memory-max-entries", "requests, responses, messages and tunnels the memory storage keeps of each, the oldest are dropped", &c.Storage.MaxEntries},
+		{"memory-max-bytes", "bytes of requests, responses, messages and tunnels the memory storage keeps of each, the oldest are dropped", &c.Storage.MaxBytes},
+		{"sqlite-path", "project file of the sqlite storage, created when missing", &c.Storage.SqlitePath},
+		{"body-threshold", "bodies larger than this many bytes are stored apart from their records, once per content, never when 0", &c.Storage.BodyThreshold},
+		{"body-dir", "directory for the bodies stored apart, GridFS is used when empty with mongo storage", &c.Storage.BodyDir},
+		{"mongo-uri", "URI of the MongoDB that stores the traffic", &c.Mongo.Uri},
+
+		{"proxy-port", "port of the HTTP proxy listener", &c.Proxy.Port},
+		{"socks-port", "port of the SOCKS5 listener, disabled when 0", &c.Proxy.SocksPort},
+		{"transparent-port", "port of the transparent listener for redirected traffic, disabled when 0", &c.Proxy.TransparentPort},
+		{"timeout", "timeout of upstream dials and TLS handshakes", &c.Proxy.Timeout},
+		{"idle-timeout", "how long an idle client or tunnel connection is kept open", &c.Proxy.IdleTimeout},
+
+		{"proxy-users", "comma separated user:password pairs required as Basic Proxy-Authorization on the proxy listener and as username/password on the SOCKS5 one", &c.Proxy.Users},
+		{"allowed-ips", "comma separated IPs or CIDRs allowed to use the proxy, SOCKS5 and transparent listeners, any when empty", &c.Proxy.AllowedIps},
+		{"socks-user", "extra username accepted by the SOCKS5 listener", &c.Proxy.SocksUser},
+		{"socks-password", "password of the extra SOCKS5 user", &c.Proxy.SocksPassword},
+
+		{"pool-max-idle", "idle upstream connections kept per host:port", &c.Proxy.PoolMaxIdle},
+		{"pool-idle-timeout", "how long an idle upstream connection is kept", &c.Proxy.PoolIdleTimeout},
+		{"max-captured-size", "response body bytes stored per response, the rest is marked truncated", &c.Proxy.MaxCapturedSize},
+		{"max-rewrite-size", "largest body the rewrite rules and scripts are applied to", &c.Proxy.MaxRewriteSize},
+		{"scripts-dir", "directory of *.star scripts with onRequest/onResponse hooks, reloaded on change", &c.Proxy.ScriptsDir},
+
+		{"upstream-proxy", "forward through http://[user:pass@]host:port or socks5://[user:pass@]host:port", &c.Proxy.UpstreamProxy},
+		{"upstream-include", "comma separated host globs or CIDRs sent through the upstream proxy, all hosts when empty", &c.Proxy.UpstreamInclude},
+		{"upstream-exclude", "comma separated host globs or CIDRs that always go direct", &c.Proxy.UpstreamExclude},
+
+		{"passthrough-hosts", "comma separated host globs or CIDRs whose tunnels are relayed without decryption", &c.Proxy.PassthroughHosts},
+		{"passthrough-ports", "comma separated ports whose tunnels are relayed without decryption", &c.Proxy.PassthroughPorts},
+		{"passthrough-after-failures", "client rejections of the certificate after which a host is relayed without decryption, never when 0", &c.Proxy.PassthroughAfterFailures},
+
+		{"intercept-timeout", "how long an intercepted message is held before the default action", &c.Proxy.InterceptTimeout},
+		{"intercept-default", "action for intercepted messages that time out, forward or drop", &c.Proxy.InterceptDefault},
+
+		{"scope-include", "comma separated [scheme://]host[:port][/path] rules of the project scope, everything when empty", &c.Proxy.ScopeInclude},
+		{"scope-exclude", "comma separated [scheme://]host[:port][/path] rules excluded from the scope", &c.Proxy.ScopeExclude},
+		{"scope-out", "what happens to out-of-scope traffic, skip or tag", &c.Proxy.ScopeOut},
+
+		{"api-host", "address the API listens on, all interfaces when empty; anything but loopback requires an admin token", &c.Api.Host},
+		{"api-port", "port of the API", &c.Api.Port},
+		{"api-admin-token", "admin token of the API, which creates viewer and operator tokens; the API is open when empty and then only listens on loopback", &c.Api.AdminToken},
+		{"api-timeout", "timeout of the requests the API repeats and scans", &c.Api.Timeout},
+
+		{"ca-cert", "CA certificate the leaf certificates are signed with", &c.Certificates.CaCert},
+		{"ca-key", "private key of the CA certificate", &c.Certificates.CaKey},
+		{"leaf-key", "private key of the generated leaf certificates", &c.Certificates.LeafKey},
+		{"certs-dir", "directory the generated leaf certificates are kept in", &c.Certificates.Dir},
+		{"certs-max-cached", "generated leaf certificates kept, the least recently used are deleted", &c.Certificates.MaxCached},
+
+		{"shutdown-timeout", "how long connections may take to finish on shutdown before they are closed", &c.ShutdownTimeout},
+	}
+}
+
+func (o *option) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+func (o *option) set(value string) error {
+	switch target := o.value.(type) {
+	case *string:
+		*target = value
+
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+
+	case *int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+
+	case *time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+
+	case *[]string:
+		*target = hostmatch.Split(value)
+
+	case *[]int:
+		ports := make([]int, 0)
+		for _, elem := range hostmatch.Split(value) {
+			port, err := strconv.Atoi(elem)
+			if err != nil {
+				return fmt.Errorf("bad port %q", elem)
+			}
+			ports = append(ports, port)
+		}
+		*target = ports
+
+	case *map[string]string:
+		users := make(map[string]string)
+		for _, elem := range hostmatch.Split(value) {
+			user, password, ok := strings.Cut(elem, ":")
+			if !ok || user == "" {
+				return fmt.Errorf("bad user %q", elem)
+			}
+			users[user] = password
+		}
+		*target = users
+
+	default:
+		return fmt.Errorf("unsupported option type %T", o.value)
+	}
+
+	return nil
+}
+
+func (o *option) String() string {
+	switch target := o.value.(type) {
+	case *string:
+		return *target
+	case *int:
+		return strconv.Itoa(*target)
+	case *int64:
+		return strconv.FormatInt(*target, 10)
+	case *time.Duration:
+		return target.String()
+	case *[]string:
+		return strings.Join(*target, ",")
+	case *[]int:
+		ports := make([]string, 0, len(*target))
+		for _, port := range *target {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		return strings.Join(ports, ",")
+	case *map[string]string:
+		// Passwords are not shown in the usage.
+		users := make([]string, 0, len(*target))
+		for user := range *target {
+			users = append(users, user+":***")
+		}
+		return strings.Join(users, ",")
+	}
+
+	return ""
+}
+
+// flagValue only remembers the flags given on the command line, they are
+// applied after the config file and the environment.
+type flagValue struct {
+	option *option
+	given  map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f.option == nil {
+		return ""
+	}
+
+	return f.option.String()
+}
+
+func (f *flagValue) Set(value string) error {
+	// Parsing here reports bad values next to the flag usage.
+	probe := &option{name: f.option.name, value: zeroOf(f.option.value)}
+	err := probe.set(value)
+	if err != nil {
+		return err
+	}
+
+	f.given[f.option.name] = value
+	return nil
+}
+
+func zeroOf(value interface{}) interface{} {
+	switch value.(type) {
+	case *string:
+		return new(string)
+	case *int:
+		return new(int)
+	case *int64:
+		return new(int64)
+	case *time.Duration:
+		return new(time.Duration)
+	case *[]string:
+		return new([]string)
+	case *[]int:
+		return new([]int)
+	case *map[string]string:
+		return new(map[string]string)
+	}
+
+	return value
+}
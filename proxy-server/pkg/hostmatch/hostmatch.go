@@ -0,0 +1,53 @@
+package hostmatch
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// Match reports whether host matches pattern. A pattern is either an IP
+// network in CIDR notation, which only matches IP hosts, or a glob such as
+// "*.example.com". Matching is case insensitive.
+func Match(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return false
+		}
+
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	}
+
+	matched, err := path.Match(pattern, host)
+	return err == nil && matched
+}
+
+func MatchAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Split parses a comma separated list of patterns as given on the command
+// line.
+func Split(list string) []string {
+	res := make([]string, 0, 4)
+
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			res = append(res, elem)
+		}
+	}
+
+	return res
+}
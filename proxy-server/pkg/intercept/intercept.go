@@ -0,0 +1,419 @@
+package intercept
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"proxy-server/pkg/hostmatch"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StageRequest  = "request"
+	StageResponse = "response"
+	StageBoth     = "both"
+)
+
+const (
+	ActionForward = "forward"
+	ActionDrop    = "drop"
+)
+
+const DefaultTimeout = time.Minute
+
+var ErrNotHeld = errors.New("message is not held")
+
+// Config controls what happens to held messages nobody decided on.
+type Config struct {
+	Timeout       time.Duration
+	DefaultAction string
+}
+
+// Rule selects traffic to hold. Empty fields match anything. Host is a glob
+// or CIDR, Path and Value are regular expressions, Value is matched against
+// the values of the Header header.
+type Rule struct {
+	Stage  string `json:"stage"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Method string `json:"method,omitempty"`
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+
+	path  *regexp.Regexp
+	value *regexp.Regexp
+}
+
+// Held is a request or response waiting for a decision. Url is absolute.
+type Held struct {
+	Id      string      `json:"id"`
+	Stage   string      `json:"stage"`
+	Method  string      `json:"method"`
+	Url     string      `json:"url"`
+	Status  int         `json:"status,omitempty"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+	HeldAt  time.Time   `json:"held_at"`
+
+	decision chan *Decision
+}
+
+// Edit changes a held message before it is forwarded. Nil fields are left
+// as they are, Headers replaces all headers when set.
+type Edit struct {
+	Method  *string     `json:"method,omitempty"`
+	Url     *string     `json:"url,omitempty"`
+	Status  *int        `json:"status,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    *string     `json:"body,omitempty"`
+}
+
+type Decision struct {
+	Action string
+	Edit   Edit
+}
+
+type Queue struct {
+	mutex  sync.Mutex
+	rules  []*Rule
+	held   map[string]*Held
+	order  []string
+	nextId int64
+	config Config
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewQueue(config Config) (*Queue, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	switch config.DefaultAction {
+	case "":
+		config.DefaultAction = ActionForward
+	case ActionForward, ActionDrop:
+	default:
+		return nil, fmt.Errorf("unknown intercept action %q", config.DefaultAction)
+	}
+
+	return &Queue{
+		held:   make(map[string]*Held),
+		config: config,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (q *Queue) SetRules(rules []*Rule) error {
+	for _, rule := range rules {
+		switch rule.Stage {
+		case StageRequest, StageResponse, StageBoth:
+		case "":
+			rule.Stage = StageBoth
+		default:
+			return fmt.Errorf("unknown intercept stage %q", rule.Stage)
+		}
+
+		var err error
+		if rule.Path != "" {
+			rule.path, err = regexp.Compile(rule.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		if rule.Value != "" {
+			rule.value, err = regexp.Compile(rule.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	q.mutex.Lock()
+	q.rules = rules
+	q.mutex.Unlock()
+
+	return nil
+}
+
+func (q *Queue) Rules() []*Rule {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.rules
+}
+
+// MatchRequest reports whether req, whose URL must be absolute, has to be
+// held before it is sent.
+func (q *Queue) MatchRequest(req *http.Request) bool {
+	return q.match(StageRequest, req, req.Header)
+}
+
+// MatchResponse reports whether the response to req has to be held before
+// it is written to the client.
+func (q *Queue) MatchResponse(req *http.Request, resp *http.Response) bool {
+	return q.match(StageResponse, req, resp.Header)
+}
+
+func (q *Queue) match(stage string, req *http.Request, header http.Header) bool {
+	q.mutex.Lock()
+	rules := q.rules
+	q.mutex.Unlock()
+
+	for _, rule := range rules {
+		if rule.matches(stage, req, header) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matches(stage string, req *http.Request, header http.Header) bool {
+	if r.Stage != stage && r.Stage != StageBoth {
+		return false
+	}
+
+	if r.Host != "" && !hostmatch.Match(r.Host, req.URL.Hostname()) {
+		return false
+	}
+
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if r.Header == "" {
+		return true
+	}
+
+	values, ok := header[http.CanonicalHeaderKey(r.Header)]
+	if !ok {
+		return false
+	}
+
+	if r.value == nil {
+		return true
+	}
+
+	for _, value := range values {
+		if r.value.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HoldRequest parks req until it is forwarded, dropped or times out, and
+// applies the edits made meanwhile. It reports whether req should be sent.
+func (q *Queue) HoldRequest(req *http.Request) (bool, error) {
+	body, err := readBody(req.Body)
+	if err != nil {
+		return false, err
+	}
+
+	decision := q.hold(&Held{
+		Stage:   StageRequest,
+		Method:  req.Method,
+		Url:     req.URL.String(),
+		Headers: req.Header.Clone(),
+		Body:    string(body),
+	})
+
+	edit := decision.Edit
+
+	if edit.Method != nil {
+		req.Method = *edit.Method
+	}
+
+	if edit.Url != nil {
+		target, err := req.URL.Parse(*edit.Url)
+		if err != nil {
+			return false, err
+		}
+
+		req.URL = target
+		req.Host = target.Host
+	}
+
+	if edit.Headers != nil {
+		req.Header = edit.Headers
+	}
+
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.TransferEncoding = nil
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	return decision.Action == ActionForward, nil
+}
+
+// HoldResponse parks the response to req the same way HoldRequest does. The
+// body of a held response is read completely.
+func (q *Queue) HoldResponse(req *http.Request, resp *http.Response) (bool, error) {
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	decision := q.hold(&Held{
+		Stage:   StageResponse,
+		Method:  req.Method,
+		Url:     req.URL.String(),
+		Status:  resp.StatusCode,
+		Headers: resp.Header.Clone(),
+		Body:    string(body),
+	})
+
+	edit := decision.Edit
+
+	if edit.Status != nil {
+		resp.StatusCode = *edit.Status
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	if edit.Headers != nil {
+		resp.Header = edit.Headers
+	}
+
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+
+	return decision.Action == ActionForward, nil
+}
+
+func (q *Queue) hold(held *Held) *Decision {
+	held.HeldAt = time.Now()
+	held.decision = make(chan *Decision, 1)
+
+	q.mutex.Lock()
+	q.nextId++
+	held.Id = strconv.FormatInt(q.nextId, 10)
+	q.held[held.Id] = held
+	q.order = append(q.order, held.Id)
+	q.mutex.Unlock()
+
+	defer q.release(held.Id)
+
+	timer := time.NewTimer(q.config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case decision := <-held.decision:
+		return decision
+	case <-timer.C:
+		return &Decision{Action: q.config.DefaultAction}
+	case <-q.closed:
+		return &Decision{Action: q.config.DefaultAction}
+	}
+}
+
+// Close applies the default action to every held message and stops holding
+// new ones, so connections waiting on a decision can finish on shutdown.
+func (q *Queue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
+
+func (q *Queue) release(id string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.held, id)
+	for i, elem := range q.order {
+		if elem == id {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// List returns the held messages, oldest first.
+func (q *Queue) List() []*Held {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	res := make([]*Held, 0, len(q.order))
+	for _, id := range q.order {
+		held, ok := q.held[id]
+		if ok {
+			res = append(res, held)
+		}
+	}
+
+	return res
+}
+
+func (q *Queue) Get(id string) (*Held, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	held, ok := q.held[id]
+	if !ok {
+		return nil, ErrNotHeld
+	}
+
+	return held, nil
+}
+
+func (q *Queue) Decide(id string, decision *Decision) error {
+	switch decision.Action {
+	case ActionForward, ActionDrop:
+	default:
+		return fmt.Errorf("unknown intercept action %q", decision.Action)
+	}
+
+	if decision.Edit.Url != nil {
+		_, err := url.Parse(*decision.Edit.Url)
+		if err != nil {
+			return err
+		}
+	}
+
+	q.mutex.Lock()
+	held, ok := q.held[id]
+	if ok {
+		delete(q.held, id)
+	}
+	q.mutex.Unlock()
+
+	if !ok {
+		return ErrNotHeld
+	}
+
+	held.decision <- decision
+	return nil
+}
+
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+
+	defer body.Close()
+	return io.ReadAll(body)
+}
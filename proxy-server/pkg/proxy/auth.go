@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"proxy-server/pkg/hostmatch"
+	"proxy-server/pkg/socks"
+	"strings"
+)
+
+const kAuthRealm = "proxy-server"
+
+// AuthConfig restricts the listeners. Clients have to authenticate as one of
+// Users when it is not empty, with Basic Proxy-Authorization on the proxy
+// listener and with username and password on the SOCKS5 one, and connect to
+// any listener from an address matching AllowedIps, IPs or CIDRs, when that
+// is not empty. Transparent clients do not know about the proxy and are only
+// checked against AllowedIps.
+type AuthConfig struct {
+	Users      map[string]string
+	AllowedIps []string
+}
+
+func (h *Handler) isAllowed(connection net.Conn) bool {
+	if len(h.config.Auth.AllowedIps) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	return hostmatch.MatchAny(h.config.Auth.AllowedIps, host)
+}
+
+// authenticate checks the credentials of the first request on a connection
+// and returns the user the connection belongs to.
+func (h *Handler) authenticate(req *http.Request) (string, bool) {
+	if len(h.config.Auth.Users) == 0 {
+		return "", true
+	}
+
+	scheme, credentials, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", false
+	}
+
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !h.checkUser(user, password) {
+		return "", false
+	}
+
+	return user, true
+}
+
+func (h *Handler) checkUser(user, password string) bool {
+	expected, known := h.config.Auth.Users[user]
+	return known && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// socksCredentials makes the SOCKS5 listener accept the proxy users as well
+// as its own user. Nil means no authentication is required.
+func (h *Handler) socksCredentials() socks.Credentials {
+	if len(h.config.Auth.Users) == 0 && h.config.Socks.Username == "" {
+		return nil
+	}
+
+	socksUser := socks.Password(h.config.Socks.Username, h.config.Socks.Password)
+
+	return func(user, password string) bool {
+		if h.config.Socks.Username != "" && socksUser(user, password) {
+			return true
+		}
+
+		return h.checkUser(user, password)
+	}
+}
+
+// requireAuth answers with 407 and closes the connection, the client retries
+// with credentials on a new one.
+func requireAuth(connection net.Conn, req *http.Request) error {
+	responce := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Close:      true,
+		Request:    req,
+	}
+	responce.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", kAuthRealm))
+
+	return writeResponce(responce, connection)
+}
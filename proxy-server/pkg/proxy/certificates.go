@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"proxy-server/pkg/ca"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultMaxCertificates = 1000
+
+// Leaf certificates are minted again this long before they expire.
+const kCertificateRenewal = 7 * 24 * time.Hour
+
+// getCertificate returns the cached leaf certificate for host, minting it on
+// first use and again when it is about to expire. Concurrent handshakes for
+// the same host share one generation. host must be a hostname or an IP, see
+// validHost.
+func (h *Handler) getCertificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	if !validHost(host) {
+		return nil, fmt.Errorf("no certificate for invalid host %q", host)
+	}
+
+	h.mutex.Lock()
+	certificate, certExists := h.certificates.get(host)
+	h.mutex.Unlock()
+
+	if certExists && !expiresSoon(certificate.Leaf) {
+		return certificate, nil
+	}
+
+	value, err, _ := h.generation.Do(host, func() (interface{}, error) {
+		return h.generateCertificate(host)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.(*tls.Certificate), nil
+}
+
+func (h *Handler) generateCertificate(host string) (*tls.Certificate, error) {
+	h.mutex.Lock()
+	certificate, certExists := h.certificates.get(host)
+	h.mutex.Unlock()
+
+	if certExists && !expiresSoon(certificate.Leaf) {
+		return certificate, nil
+	}
+
+	fmt.Printf("Generating certificate for %s\n", host)
+
+	certInBytes, err := h.authority.Sign(host, h.leafKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate: %v", err)
+	}
+
+	pair, err := parseCertificate(certInBytes, h.key)
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate: %v", err)
+	}
+
+	err = os.WriteFile(certificatePath(h.config.Certificates.Dir, host), certInBytes, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate: %v", err)
+	}
+
+	h.mutex.Lock()
+	evicted := h.certificates.add(host, pair)
+	h.mutex.Unlock()
+
+	removeCertificates(h.config.Certificates.Dir, evicted)
+
+	return pair, nil
+}
+
+// parseCertificate pairs a PEM encoded leaf with key and keeps the parsed
+// leaf for the expiry checks.
+func parseCertificate(certInBytes, key []byte) (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair(certInBytes, key)
+	if err != nil {
+		return nil, err
+	}
+
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &pair, nil
+}
+
+func expiresSoon(leaf *x509.Certificate) bool {
+	return time.Now().Add(kCertificateRenewal).After(leaf.NotAfter)
+}
+
+// CertificateConfig locates the CA that signs minted leaves, the key shared by
+// all leaves and the directory minted certificates are cached in. At most
+// MaxCached certificates are kept, the least recently used are removed from
+// memory and from Dir.
+type CertificateConfig struct {
+	CaCert    string
+	CaKey     string
+	LeafKey   string
+	Dir       string
+	MaxCached int
+}
+
+// certificateCache keeps leaf certificates by host in least recently used
+// order. It is guarded by Handler.mutex.
+type certificateCache struct {
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cachedCertificate struct {
+	host        string
+	certificate *tls.Certificate
+}
+
+func newCertificateCache(max int) *certificateCache {
+	if max <= 0 {
+		max = DefaultMaxCertificates
+	}
+
+	return &certificateCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *certificateCache) get(host string) (*tls.Certificate, bool) {
+	elem, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedCertificate).certificate, true
+}
+
+// add stores the certificate of host and returns the hosts dropped to stay
+// within the limit.
+func (c *certificateCache) add(host string, certificate *tls.Certificate) []string {
+	if elem, ok := c.entries[host]; ok {
+		elem.Value.(*cachedCertificate).certificate = certificate
+		c.order.MoveToFront(elem)
+		return nil
+	}
+
+	c.entries[host] = c.order.PushFront(&cachedCertificate{host: host, certificate: certificate})
+
+	evicted := make([]string, 0)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+
+		host := oldest.Value.(*cachedCertificate).host
+		delete(c.entries, host)
+		evicted = append(evicted, host)
+	}
+
+	return evicted
+}
+
+// loadCertificates fills a cache of max entries from dir, the most recently
+// written certificates win and the rest are removed. Certificates that do not
+// match key, were not signed by authority or are about to expire are removed
+// as well, so they are minted again on first use.
+func loadCertificates(dir string, key []byte, authority *ca.Authority, max int) (*certificateCache, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		host := strings.TrimSuffix(entry.Name(), ".crt")
+		if host == entry.Name() || !validHost(host) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, info)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	res := newCertificateCache(max)
+
+	for _, file := range files {
+		host := strings.TrimSuffix(file.Name(), ".crt")
+
+		certInBytes, err := os.ReadFile(certificatePath(dir, host))
+		if err != nil {
+			return nil, err
+		}
+
+		pair, err := parseCertificate(certInBytes, key)
+		if err == nil && expiresSoon(pair.Leaf) {
+			err = fmt.Errorf("expires at %s", pair.Leaf.NotAfter)
+		}
+		if err == nil {
+			err = pair.Leaf.CheckSignatureFrom(authority.Certificate())
+		}
+		if err != nil {
+			fmt.Printf("Dropping certificate for %s: %v\n", host, err)
+			removeCertificates(dir, []string{host})
+			continue
+		}
+
+		removeCertificates(dir, res.add(host, pair))
+	}
+
+	return res, nil
+}
+
+func removeCertificates(dir string, hosts []string) {
+	for _, host := range hosts {
+		err := os.Remove(certificatePath(dir, host))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+	}
+}
+
+func certificatePath(dir, host string) string {
+	return filepath.Join(dir, host+".crt")
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// validHost reports whether host is an IP or a DNS name, the only names a
+// certificate is minted for. Anything else, such as a client's SNI with
+// slashes, must not reach the certificate directory.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, char := range label {
+			if !(char >= 'a' && char <= 'z' || char >= '0' && char <= '9' || char == '-' || char == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
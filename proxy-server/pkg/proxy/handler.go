@@ -2,8 +2,8 @@ package proxy
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"crypto"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -13,28 +13,96 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/exec"
+	"proxy-server/pkg/ca"
+	"proxy-server/pkg/chain"
+	"proxy-server/pkg/intercept"
 	"proxy-server/pkg/repository"
-	"strings"
+	"proxy-server/pkg/rewrite"
+	"proxy-server/pkg/scope"
+	"proxy-server/pkg/script"
+	"proxy-server/pkg/websocket"
 	"sync"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/singleflight"
 )
 
+const DefaultMaxCapturedSize = 10 << 20
+
+type Config struct {
+	Pool            PoolConfig
+	MaxCapturedSize int64
+	Socks           SocksConfig
+	Chain           chain.Config
+	Passthrough     PassthroughConfig
+	Intercept       intercept.Config
+	MaxRewriteSize  int64
+	Scripts         script.Config
+	Scope           scope.Config
+	Auth            AuthConfig
+	Certificates    CertificateConfig
+	Timeout         time.Duration
+	IdleTimeout     time.Duration
+}
+
 type Handler struct {
-	certificates  map[string][]byte
+	certificates  *certificateCache
+	generation    singleflight.Group
 	mutex         sync.Mutex
 	key           []byte
+	leafKey       crypto.Signer
+	authority     *ca.Authority
+	dialer        *chain.Dialer
+	pool          *connectionPool
+	interceptor   *intercept.Queue
+	rewriter      *rewrite.Engine
+	scripts       *script.Runner
+	scope         *scope.Scope
+	http2         *http2Upstream
+	config        Config
 	requestSaver  repository.RequestSaver
 	responseSaver repository.ResponseSaver
+	messageSaver  repository.MessageSaver
+	tunnelSaver   repository.TunnelSaver
+	pinningSaver  repository.PinningSaver
+	rewriteSaver  repository.RewriteSaver
+
+	autoPassthrough map[string]bool
 }
 
-func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver) (*Handler, error) {
-	keyInBytes, err := os.ReadFile("https/cert.key")
+func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver, messages repository.MessageSaver, tunnels repository.TunnelSaver, pinning repository.PinningSaver, rewrites repository.RewriteSaver, config Config) (*Handler, error) {
+	keyInBytes, err := os.ReadFile(config.Certificates.LeafKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ca.ParsePrivateKey(keyInBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	authority, err := ca.NewAuthority(config.Certificates.CaCert, config.Certificates.CaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates, err := loadCertificates(config.Certificates.Dir, keyInBytes, authority, config.Certificates.MaxCached)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := chain.NewDialer(config.Chain, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	interceptor, err := intercept.NewQueue(config.Intercept)
 	if err != nil {
 		return nil, err
 	}
 
-	certificates, err := loadCertificates()
+	projectScope, err := scope.New(config.Scope)
 	if err != nil {
 		return nil, err
 	}
@@ -42,157 +110,388 @@ func NewHandler(req repository.RequestSaver, resp repository.ResponseSaver) (*Ha
 	return &Handler{
 		certificates:  certificates,
 		key:           keyInBytes,
+		leafKey:       leafKey,
+		authority:     authority,
+		dialer:        dialer,
+		pool:          newConnectionPool(config.Pool, dialer),
+		interceptor:   interceptor,
+		rewriter:      loadRewriteRules(rewrites, config.MaxRewriteSize),
+		scripts:       script.NewRunner(config.Scripts),
+		scope:         projectScope,
+		http2:         newHttp2Upstream(),
+		config:        config,
 		requestSaver:  req,
 		responseSaver: resp,
+		messageSaver:  messages,
+		tunnelSaver:   tunnels,
+		pinningSaver:  pinning,
+		rewriteSaver:  rewrites,
+
+		autoPassthrough: loadAutoPassthrough(pinning),
 	}, nil
 }
 
-func (h *Handler) Handle(connection net.Conn) error {
-	req, err := http.ReadRequest(bufio.NewReader(connection))
+func (h *Handler) Handle(ctx context.Context, connection net.Conn) error {
+	if !h.isAllowed(connection) {
+		return fmt.Errorf("%s is not allowed to use the proxy", connection.RemoteAddr())
+	}
+
+	reader := newReader(connection)
+
+	connection.SetReadDeadline(time.Now().Add(h.config.Timeout))
+	req, err := readRequest(ctx, connection, reader)
 	if err != nil {
 		return err
 	}
 
-	return h.handleRequest(connection, req)
+	user, ok := h.authenticate(req)
+	if !ok {
+		return requireAuth(connection, req)
+	}
+
+	if req.Method == http.MethodConnect {
+		return h.handleTunnel(ctx, connection, req, user)
+	}
+
+	return h.serve(ctx, connection, reader, req, "http", "", user)
 }
 
-func (h *Handler) handleRequest(clientConnection net.Conn, toProxy *http.Request) error {
-	var hostConnection net.Conn
-	var err error
-	host := toProxy.URL.Hostname()
-	port := getPort(toProxy.URL)
+func (h *Handler) handleTunnel(ctx context.Context, clientConnection net.Conn, connect *http.Request, user string) error {
+	host := connect.URL.Hostname()
+	port := connect.URL.Port()
+	if port == "" {
+		port = "443"
+	}
 
-	// fmt.Println("host: ", host)
-	// fmt.Println("port: ", port)
-	// fmt.Println(toProxy.Method)
+	_, err := clientConnection.Write([]byte("HTTP/1.0 200 Connection Established\n\n"))
+	if err != nil {
+		return err
+	}
 
-	if toProxy.Method == http.MethodConnect {
-		clientConnection, err = h.tlsUpgrade(clientConnection, host)
-		if err != nil {
-			return err
+	if h.isPassthrough(host, port) {
+		return h.passthrough(clientConnection, host, port)
+	}
+
+	return h.intercept(ctx, clientConnection, host, port, user)
+}
+
+// intercept terminates TLS on a tunnel with a certificate minted for the
+// destination and serves the decrypted traffic over h2 or HTTP/1.1.
+func (h *Handler) intercept(ctx context.Context, clientConnection net.Conn, host, port, user string) error {
+	tlsConnection := h.tlsUpgrade(clientConnection, host)
+
+	err := tlsConnection.Handshake()
+	if err != nil {
+		h.recordHandshakeFailure(host, err)
+		return err
+	}
+
+	// Origin certificates rarely cover IP addresses, so the server name is
+	// the better upstream host whenever the destination is only an IP.
+	serverName := normalizeHost(tlsConnection.ConnectionState().ServerName)
+	if validHost(serverName) && (host == "" || net.ParseIP(host) != nil) {
+		host = serverName
+	}
+	if host == "" {
+		return errNoOriginalDestination
+	}
+
+	if tlsConnection.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		return h.serveHttp2(ctx, tlsConnection, host, port, user)
+	}
+
+	return h.serve(ctx, tlsConnection, newReader(tlsConnection), nil, "https", net.JoinHostPort(host, port), user)
+}
+
+// serve runs the request loop on a client connection. The first request may
+// already have been read by the caller. When target is empty every request
+// carries its own destination in absolute-form, otherwise all requests go to
+// target. user is the authenticated client the requests are attributed to.
+// Once ctx is cancelled the request in progress is finished and the
+// connection is closed.
+func (h *Handler) serve(ctx context.Context, clientConnection net.Conn, reader *bufio.Reader, req *http.Request, scheme, target, user string) error {
+	for {
+		if req == nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			clientConnection.SetReadDeadline(time.Now().Add(h.config.IdleTimeout))
+
+			var err error
+			req, err = readRequest(ctx, clientConnection, reader)
+			if err != nil {
+				if isClosed(err) {
+					return nil
+				}
+				return err
+			}
 		}
 
-		toProxy, err = http.ReadRequest(bufio.NewReader(clientConnection))
+		clientConnection.SetReadDeadline(time.Now().Add(h.config.Timeout))
+
+		keepAlive, err := h.handleRequest(ctx, clientConnection, reader, req, scheme, target, user)
 		if err != nil {
 			return err
 		}
 
-		toProxy.URL.Scheme = "https"
-		hostConnection, err = tlsConnect(host, port)
-		if err != nil {
-			return err
+		io.Copy(io.Discard, req.Body)
+
+		if !keepAlive {
+			return nil
 		}
-	} else {
-		toProxy.URL.Scheme = "http"
-		hostConnection, err = tcpConnect(host, port)
+
+		req = nil
+	}
+}
+
+func (h *Handler) handleRequest(ctx context.Context, clientConnection net.Conn, clientReader *bufio.Reader, toProxy *http.Request, scheme, target, user string) (bool, error) {
+	host := toProxy.URL.Hostname()
+	port := getPort(toProxy.URL)
+
+	// Requests in origin-form name their destination only in the Host header.
+	if host == "" && target == "" {
+		toProxy.URL.Host = toProxy.Host
+		toProxy.URL.Scheme = scheme
+		host = toProxy.URL.Hostname()
+		port = getPort(toProxy.URL)
+	}
+
+	if host == "" && target == "" {
+		return false, errNoOriginalDestination
+	}
+
+	// A target only says where to connect to, for a transparent client it is
+	// just the address the connection was redirected to. The site is named by
+	// the Host header, so scope and recording go by that.
+	name := host
+	if target != "" {
+		var err error
+		host, port, err = net.SplitHostPort(target)
 		if err != nil {
-			return err
+			return false, err
+		}
+
+		name = host
+		if hostname := normalizeHost(requestHostname(toProxy)); validHost(hostname) {
+			name = hostname
 		}
 	}
 
-	defer hostConnection.Close()
+	toProxy.URL.Scheme = scheme
+	toProxy.URL.Host = net.JoinHostPort(host, port)
+
+	if h.interceptor.MatchRequest(toProxy) {
+		forward, err := h.interceptor.HoldRequest(toProxy)
+		if err != nil || !forward {
+			return false, err
+		}
+
+		if toProxy.URL.Host != net.JoinHostPort(host, port) {
+			host = toProxy.URL.Hostname()
+			port = getPort(toProxy.URL)
+			name = host
+		}
+	}
 
 	toProxy.URL.Host = ""
 	//toProxy.URL.Scheme = ""
 	toProxy.RequestURI = ""
 	toProxy.Header.Del("Proxy-Connection")
+	toProxy.Header.Del("Proxy-Authorization")
 	toProxy.Header.Del("Accept-Encoding")
-	toProxy.Header.Set("Host", host)
+	toProxy.Header.Set("Host", name)
+	if toProxy.Host == "" {
+		toProxy.Host = name
+	}
 
-	fmt.Println(toProxy)
+	// Compressed frames could not be decoded for the message history.
+	upgrade := websocket.IsUpgrade(toProxy.Header)
+	if upgrade {
+		toProxy.Header.Del("Sec-WebSocket-Extensions")
+	}
 
-	requestId, err := h.requestSaver.Save(toProxy)
+	err := h.rewriter.ApplyRequest(toProxy)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	responce, err := sendRequest(hostConnection, toProxy)
+	h.scripts.OnRequest(toProxy)
+
+	fmt.Println(toProxy)
+
+	toProxy = repository.WithUser(toProxy, user)
+	requestId, err := h.saveRequest(toProxy, h.scope.Contains(scheme, name, port, toProxy.URL.Path))
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	defer responce.Body.Close()
+	if upgrade {
+		return false, h.handleWebSocket(clientConnection, clientReader, toProxy, requestId, scheme, host, port)
+	}
 
-	h.responseSaver.Save(requestId, responce)
+	// The client's wish to close only concerns the client side, the upstream
+	// connection is kept alive for the pool.
+	clientClose := toProxy.Close
+	toProxy.Close = false
+	toProxy.Header.Del("Connection")
 
-	return writeResponce(responce, clientConnection)
+	hostConnection, err := h.pool.Get(scheme, host, port)
+	if err != nil {
+		return false, err
+	}
 
-}
+	responce, err := sendRequest(hostConnection, toProxy)
+	if err != nil && hostConnection.reused {
+		hostConnection.Close()
 
-func (h *Handler) tlsUpgrade(clientConnection net.Conn, host string) (net.Conn, error) {
-	_, err := clientConnection.Write([]byte("HTTP/1.0 200 Connection Established\n\n"))
+		hostConnection, err = h.pool.Dial(scheme, host, port)
+		if err != nil {
+			return false, err
+		}
+
+		responce, err = sendRequest(hostConnection, toProxy)
+	}
 	if err != nil {
-		return nil, err
+		hostConnection.Close()
+		return false, err
 	}
 
-	err = h.generateCertificate(host)
+	reusable := false
+	defer func() {
+		if reusable {
+			h.pool.Put(hostConnection)
+		} else {
+			hostConnection.Close()
+		}
+	}()
+
+	err = h.rewriter.ApplyResponse(responce)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+
+	h.scripts.OnResponse(toProxy, responce, requestId)
+
+	toProxy.URL.Host = net.JoinHostPort(host, port)
+	if h.interceptor.MatchResponse(toProxy, responce) {
+		forward, err := h.interceptor.HoldResponse(toProxy, responce)
+		if err != nil {
+			return false, err
+		}
+
+		if !forward {
+			_, err = h.saveResponse(requestId, responce)
+			return false, err
+		}
+	}
+	toProxy.URL.Host = ""
+
+	capture := repository.NewCapture(responce.Body, h.config.MaxCapturedSize)
+	responce.Body = capture
+	defer capture.Close()
+
+	upstreamClose := responce.Close
+	if clientClose || ctx.Err() != nil {
+		responce.Close = true
 	}
 
-	cfg, err := h.getTlsConfig(host)
+	writeErr := writeResponce(responce, clientConnection)
+
+	_, err = h.saveResponse(requestId, responce)
 	if err != nil {
-		return nil, err
+		fmt.Println(err)
 	}
 
-	tlsConnection := tls.Server(clientConnection, cfg)
-	clientConnection.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	if writeErr != nil {
+		return false, writeErr
+	}
 
-	return tlsConnection, nil
+	reusable = !upstreamClose
 
+	return !responce.Close, nil
 }
 
-func (h *Handler) generateCertificate(host string) error {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+func (h *Handler) Interceptor() *intercept.Queue {
+	return h.interceptor
+}
 
-	_, certExists := h.certificates[host]
-	if !certExists {
-		fmt.Printf("Generating certificate for %s\n", host)
+func (h *Handler) RewriteRules() []*repository.RewriteRule {
+	return h.rewriter.Rules()
+}
 
-		cmd := exec.Command("./https/gen.sh", host)
-		var out strings.Builder
-		cmd.Stdout = &out
+// SetRewriteRules stores rules for the next start and activates them. Copies
+// are stored and activated, so the caller keeps its rules and requests in
+// progress never see one being changed.
+func (h *Handler) SetRewriteRules(rules []*repository.RewriteRule) error {
+	copies := make([]*repository.RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		value := *rule
+		copies = append(copies, &value)
+	}
 
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("error generating certificate: %v", err)
-		}
+	err := rewrite.Check(copies)
+	if err != nil {
+		return err
+	}
 
-		certificate := []byte(out.String())
+	err = h.rewriteSaver.Replace(copies)
+	if err != nil {
+		return err
+	}
 
-		cert, err := os.Create(fmt.Sprintf("certs/%s.crt", host))
-		if err != nil {
-			return fmt.Errorf("error generating certificate: %v", err)
-		}
+	return h.rewriter.SetRules(copies)
+}
 
-		defer cert.Close()
+func loadRewriteRules(rewrites repository.RewriteSaver, maxBodySize int64) *rewrite.Engine {
+	engine := rewrite.NewEngine(maxBodySize)
 
-		var written int64 = 0
+	rules, err := rewrites.List()
+	if err != nil {
+		fmt.Println(err)
+		return engine
+	}
 
-		written, err = io.Copy(cert, bytes.NewReader(certificate))
-		if err != nil {
-			return fmt.Errorf("error generating certificate: %v", err)
-		}
+	err = engine.SetRules(rules)
+	if err != nil {
+		fmt.Println(err)
+	}
 
-		if written == 0 {
-			certificate = nil
-			return errors.New("no bytes written during certificate creation")
-		}
+	return engine
+}
 
-		h.certificates[host] = certificate
-	}
+func (h *Handler) Scripts() []*script.Script {
+	return h.scripts.List()
+}
 
-	return nil
+// Close is called on shutdown once the listeners are closed. Held messages
+// get the default intercept action and idle upstream connections are closed,
+// requests still in progress are finished.
+func (h *Handler) Close() {
+	h.interceptor.Close()
+	h.pool.CloseIdle()
+}
 
+func (h *Handler) PoolStats() PoolStats {
+	return h.pool.Stats()
 }
 
-func (h *Handler) getTlsConfig(host string) (*tls.Config, error) {
-	cert, err := tls.X509KeyPair(h.certificates[host], h.key)
-	if err != nil {
-		return nil, err
+func (h *Handler) tlsUpgrade(clientConnection net.Conn, host string) *tls.Conn {
+	cfg := &tls.Config{
+		NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Clients choose the SNI freely, a missing or malformed one
+			// falls back to the destination of the tunnel.
+			serverName := normalizeHost(hello.ServerName)
+			if !validHost(serverName) {
+				serverName = host
+			}
+
+			return h.getCertificate(serverName)
+		},
 	}
-	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+
+	return tls.Server(clientConnection, cfg)
 }
 
 func getPort(url *url.URL) string {
@@ -210,14 +509,64 @@ func getPort(url *url.URL) string {
 
 }
 
-const DefaultTimeout = time.Second * 10
+// requestHostname is the host of the Host header of req without its port.
+func requestHostname(req *http.Request) string {
+	return (&url.URL{Host: req.Host}).Hostname()
+}
+
+// readRequest waits for the next request on a client connection and keeps
+// its head as received with it. Cancelling ctx ends the wait, so idle
+// keep-alive connections close on shutdown.
+func readRequest(ctx context.Context, connection net.Conn, reader *bufio.Reader) (*http.Request, error) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-ctx.Done():
+			connection.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var req *http.Request
+
+	head, err := peekHead(reader)
+	if err == nil {
+		req, err = http.ReadRequest(reader)
+	}
+
+	close(stop)
+	<-done
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.WithRawHead(req, head), nil
+}
+
+func isClosed(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
-func tcpConnect(host, port string) (net.Conn, error) {
+func tcpConnect(dialer *chain.Dialer, host, port string) (net.Conn, error) {
 	fmt.Println("tcp", host+":"+port)
-	return net.DialTimeout("tcp", host+":"+port, DefaultTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout())
+	defer cancel()
+
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 }
 
-func sendRequest(connection net.Conn, req *http.Request) (*http.Response, error) {
+func sendRequest(connection *upstreamConnection, req *http.Request) (*http.Response, error) {
 	bytes, err := httputil.DumpRequest(req, true)
 	if err != nil {
 		return nil, err
@@ -230,44 +579,49 @@ func sendRequest(connection net.Conn, req *http.Request) (*http.Response, error)
 		return nil, err
 	}
 
-	return http.ReadResponse(bufio.NewReader(connection), req)
-}
-
-func writeResponce(resp *http.Response, connection net.Conn) error {
-	bytes, err := httputil.DumpResponse(resp, true)
+	head, err := peekHead(connection.reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = connection.Write(bytes)
-	return err
-}
 
-func loadCertificates() (map[string][]byte, error) {
-	entries, err := os.ReadDir("certs")
+	resp, err := http.ReadResponse(connection.reader, req)
 	if err != nil {
 		return nil, err
 	}
 
-	res := make(map[string][]byte, len(entries))
+	repository.SetRawResponseHead(resp, head)
+	return resp, nil
+}
 
-	for _, entry := range entries {
-		host := strings.TrimSuffix(entry.Name(), ".crt")
+// writeResponce streams the response to the client as the body arrives, so
+// downloads and event streams are not buffered in memory first.
+func writeResponce(resp *http.Response, connection net.Conn) error {
+	return resp.Write(connection)
+}
 
-		res[host], err = os.ReadFile("certs/" + entry.Name())
-		if err != nil {
-			return nil, err
-		}
+func tlsConnect(dialer *chain.Dialer, host, port string, protocols []string) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout())
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
 	}
 
-	return res, nil
-}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: host,
+		NextProtos: protocols,
+	})
 
-func tlsConnect(host, port string) (net.Conn, error) {
-	dialer := tls.Dialer{}
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
-	defer cancel()
-	conn, err := dialer.DialContext(ctx, "tcp", host+":"+port)
+	return tlsConn, nil
+}
 
-	return conn, err
+func (h *Handler) Dialer() *chain.Dialer {
+	return h.dialer
 }
@@ -0,0 +1,459 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-server/pkg/repository"
+	"proxy-server/pkg/scope"
+)
+
+// testStorage is the memory backend a test handler records into.
+type testStorage struct {
+	requests  repository.RequestSaver
+	responses repository.ResponseSaver
+}
+
+// writeCertificates creates a CA and a leaf key in a temporary directory.
+func writeCertificates(t *testing.T) CertificateConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy-server test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CertificateConfig{
+		CaCert:  filepath.Join(dir, "ca.crt"),
+		CaKey:   filepath.Join(dir, "ca.key"),
+		LeafKey: filepath.Join(dir, "cert.key"),
+		Dir:     filepath.Join(dir, "certs"),
+	}
+
+	writePem(t, config.CaCert, "CERTIFICATE", der)
+	writePem(t, config.CaKey, "EC PRIVATE KEY", marshalKey(t, caKey))
+	writePem(t, config.LeafKey, "EC PRIVATE KEY", marshalKey(t, leafKey))
+
+	err = os.Mkdir(config.Dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func writePem(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestHandler(t *testing.T, config Config) (*Handler, *testStorage) {
+	t.Helper()
+
+	if config.Certificates.Dir == "" {
+		config.Certificates = writeCertificates(t)
+	}
+	config.MaxCapturedSize = DefaultMaxCapturedSize
+	config.Timeout = 5 * time.Second
+	config.IdleTimeout = 5 * time.Second
+
+	storage := &testStorage{
+		requests:  repository.NewMemoryRequestSaver(100, 1<<20, nil),
+		responses: repository.NewMemoryResponseSaver(100, 1<<20, nil),
+	}
+
+	handler, err := NewHandler(
+		storage.requests,
+		storage.responses,
+		repository.NewMemoryMessageSaver(100, 1<<20),
+		repository.NewMemoryTunnelSaver(100, 1<<20),
+		repository.NewMemoryPinningSaver(),
+		repository.NewMemoryRewriteSaver(),
+		config,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(handler.Close)
+
+	return handler, storage
+}
+
+// roundTrip sends raw to handle over a fresh connection and reads the
+// response.
+func roundTrip(t *testing.T, handle func(context.Context, net.Conn) error, raw string) *http.Response {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		defer server.Close()
+		handle(context.Background(), &pipeConn{Conn: server})
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go io.WriteString(client, raw)
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = io.NopCloser(strings.NewReader(string(body)))
+
+	return resp
+}
+
+// pipeConn gives one end of net.Pipe a TCP remote address, as the listeners
+// see it.
+type pipeConn struct {
+	net.Conn
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func newOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Origin-Path", r.URL.Path)
+		w.Header().Set("X-Proxy-Authorization", r.Header.Get("Proxy-Authorization"))
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(origin.Close)
+
+	return origin
+}
+
+// waitForResponse returns the recorded response of a request, which is saved
+// only after it has been written to the client.
+func waitForResponse(t *testing.T, storage *testStorage, requestId string) *repository.Response {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorded, err := storage.responses.GetByRequest(requestId)
+		if err == nil {
+			return recorded
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleRecordsRequestAndResponse(t *testing.T) {
+	handler, storage := newTestHandler(t, Config{})
+	origin := newOrigin(t)
+
+	resp := roundTrip(t, handler.Handle, "GET "+origin.URL+"/path?q=1 HTTP/1.1\r\nHost: "+strings.TrimPrefix(origin.URL, "http://")+"\r\nConnection: close\r\n\r\n")
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+
+	if resp.Header.Get("X-Origin-Path") != "/path" {
+		t.Errorf("origin saw path %q", resp.Header.Get("X-Origin-Path"))
+	}
+
+	requests, err := storage.requests.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("%d requests recorded", len(requests))
+	}
+
+	if requests[0].Method != http.MethodGet || requests[0].Path != "/path" || requests[0].GetParams["q"] == nil {
+		t.Errorf("recorded %s %s %v", requests[0].Method, requests[0].Path, requests[0].GetParams)
+	}
+
+	recorded := waitForResponse(t, storage, requests[0].Id.Hex())
+
+	if recorded.Code != http.StatusOK || string(recorded.Body) != "hello" {
+		t.Errorf("recorded %d %q", recorded.Code, recorded.Body)
+	}
+}
+
+func TestHandleRequiresProxyAuth(t *testing.T) {
+	handler, storage := newTestHandler(t, Config{
+		Auth: AuthConfig{Users: map[string]string{"alice": "secret"}},
+	})
+	origin := newOrigin(t)
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	resp := roundTrip(t, handler.Handle, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("got %d without credentials", resp.StatusCode)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	resp = roundTrip(t, handler.Handle, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+host+"\r\nProxy-Authorization: Basic "+credentials+"\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d with credentials", resp.StatusCode)
+	}
+
+	if resp.Header.Get("X-Proxy-Authorization") != "" {
+		t.Error("proxy credentials reached the origin")
+	}
+
+	requests, err := storage.requests.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || requests[0].User != "alice" {
+		t.Fatalf("recorded %d requests", len(requests))
+	}
+
+	if len(requests[0].RawHead) == 0 || strings.Contains(strings.ToLower(string(requests[0].RawHead)), "proxy-authorization") {
+		t.Errorf("raw head is %q", requests[0].RawHead)
+	}
+}
+
+func TestHandleRejectsDisallowedAddresses(t *testing.T) {
+	handler, _ := newTestHandler(t, Config{
+		Auth: AuthConfig{AllowedIps: []string{"10.0.0.0/8"}},
+	})
+
+	for name, handle := range map[string]func(context.Context, net.Conn) error{
+		"proxy":       handler.Handle,
+		"socks":       handler.HandleSocks,
+		"transparent": handler.HandleTransparent,
+	} {
+		client, server := net.Pipe()
+
+		err := handle(context.Background(), &pipeConn{Conn: server})
+		if err == nil {
+			t.Errorf("%s listener accepted a client outside the allowed IPs", name)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestGetCertificateRejectsInvalidHosts(t *testing.T) {
+	handler, _ := newTestHandler(t, Config{})
+
+	for _, host := range []string{"../../tmp/pwn", "a/b", "", "a..b", "-a.com"} {
+		_, err := handler.getCertificate(host)
+		if err == nil {
+			t.Errorf("certificate minted for %q", host)
+		}
+	}
+
+	for _, host := range []string{"example.com", "Example.COM.", "127.0.0.1", "::1"} {
+		_, err := handler.getCertificate(host)
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+
+	entries, err := os.ReadDir(handler.config.Certificates.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("%d certificates written", len(entries))
+	}
+}
+
+// writeLeaf signs a leaf certificate for host with the CA of authority and
+// the leaf key of config, and stores it in config's directory.
+func writeLeaf(t *testing.T, config, authority CertificateConfig, host string, notAfter time.Time) {
+	t.Helper()
+
+	pair, err := tls.LoadX509KeyPair(authority.CaCert, authority.CaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafPem, err := os.ReadFile(config.LeafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(leafPem)
+	leafKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &leafKey.PublicKey, pair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePem(t, certificatePath(config.Dir, host), "CERTIFICATE", der)
+}
+
+func TestLoadCertificatesDropsUnusableLeaves(t *testing.T) {
+	config := writeCertificates(t)
+	foreign := writeCertificates(t)
+
+	writeLeaf(t, config, config, "valid.example", time.Now().Add(30*24*time.Hour))
+	writeLeaf(t, config, config, "expired.example", time.Now().Add(-time.Hour))
+	writeLeaf(t, config, foreign, "foreign.example", time.Now().Add(30*24*time.Hour))
+
+	handler, _ := newTestHandler(t, Config{Certificates: config})
+
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "valid.example.crt" {
+		t.Fatalf("kept %v", entries)
+	}
+
+	for _, host := range []string{"expired.example", "foreign.example"} {
+		certificate, err := handler.getCertificate(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = certificate.Leaf.CheckSignatureFrom(handler.authority.Certificate())
+		if err != nil || expiresSoon(certificate.Leaf) {
+			t.Errorf("%s: minted certificate expires at %s: %v", host, certificate.Leaf.NotAfter, err)
+		}
+	}
+}
+
+func TestGetCertificateRenewsExpiringLeaf(t *testing.T) {
+	config := writeCertificates(t)
+	writeLeaf(t, config, config, "soon.example", time.Now().Add(30*24*time.Hour))
+
+	handler, _ := newTestHandler(t, Config{Certificates: config})
+
+	stale, err := handler.getCertificate("soon.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loaded leaf is served until it comes close to its expiry.
+	stale.Leaf.NotAfter = time.Now().Add(time.Hour)
+
+	certificate, err := handler.getCertificate("soon.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if certificate == stale || expiresSoon(certificate.Leaf) {
+		t.Errorf("expiring certificate was served, it expires at %s", certificate.Leaf.NotAfter)
+	}
+}
+
+func TestServeScopesTransparentRequestsByHost(t *testing.T) {
+	handler, storage := newTestHandler(t, Config{
+		Scope: scope.Config{Include: []*scope.Rule{{Host: "app.example"}}},
+	})
+	origin := newOrigin(t)
+
+	// The target is the redirected address, the site is only in the Host
+	// header.
+	target := strings.TrimPrefix(origin.URL, "http://")
+	serve := func(ctx context.Context, conn net.Conn) error {
+		return handler.serve(ctx, conn, newReader(conn), nil, "http", target, "")
+	}
+
+	resp := roundTrip(t, serve, "GET /path HTTP/1.1\r\nHost: App.Example\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Origin-Path") != "/path" {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+
+	requests, err := storage.requests.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || len(requests[0].Tags) != 0 {
+		t.Fatalf("recorded %d requests", len(requests))
+	}
+
+	if requests[0].Host != "App.Example" || requests[0].Headers["Host"] != "app.example" {
+		t.Errorf("recorded host %q, headers %v", requests[0].Host, requests[0].Headers)
+	}
+}
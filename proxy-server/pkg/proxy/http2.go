@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"proxy-server/pkg/repository"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Upstream keeps one multiplexed client connection per origin that
+// negotiated h2 and remembers the origins that only speak HTTP/1.1.
+type http2Upstream struct {
+	mutex     sync.Mutex
+	conns     map[string]*http2.ClientConn
+	http1Only map[string]bool
+	transport *http2.Transport
+}
+
+func newHttp2Upstream() *http2Upstream {
+	return &http2Upstream{
+		conns:     make(map[string]*http2.ClientConn),
+		http1Only: make(map[string]bool),
+		transport: &http2.Transport{},
+	}
+}
+
+// serveHttp2 terminates h2 on an intercepted client connection. Every stream
+// is forwarded on its own and recorded as a separate request/response pair.
+// Cancelling ctx sends GOAWAY, the streams already open are finished.
+func (h *Handler) serveHttp2(ctx context.Context, clientConnection *tls.Conn, host, port, user string) error {
+	server := &http2.Server{
+		IdleTimeout: h.config.IdleTimeout,
+	}
+
+	// Shutting the base server down is the only way to reach the graceful
+	// shutdown of the h2 connection.
+	base := &http.Server{}
+	err := http2.ConfigureServer(base, server)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			base.Shutdown(context.Background())
+		case <-stop:
+		}
+	}()
+
+	clientConnection.SetReadDeadline(time.Time{})
+
+	server.ServeConn(clientConnection, &http2.ServeConnOpts{
+		BaseConfig: base,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := h.handleStream(w, r, host, port, user)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}),
+	})
+
+	return nil
+}
+
+func (h *Handler) handleStream(w http.ResponseWriter, r *http.Request, host, port, user string) error {
+	toProxy := r.Clone(r.Context())
+	toProxy.URL.Scheme = "https"
+	toProxy.URL.Host = r.Host
+	toProxy.RequestURI = ""
+	toProxy.Header.Del("Accept-Encoding")
+	toProxy.Header.Set("Host", host)
+
+	if h.interceptor.MatchRequest(toProxy) {
+		forward, err := h.interceptor.HoldRequest(toProxy)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return err
+		}
+
+		if !forward {
+			panic(http.ErrAbortHandler)
+		}
+
+		if toProxy.URL.Host != r.Host {
+			host = toProxy.URL.Hostname()
+			port = getPort(toProxy.URL)
+		}
+	}
+
+	err := h.rewriter.ApplyRequest(toProxy)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+
+	h.scripts.OnRequest(toProxy)
+
+	// The request is recorded before it is sent, as on HTTP/1.x, so the
+	// response hooks get its id. Its body is read completely for that.
+	toProxy = repository.WithUser(toProxy, user)
+	requestId, err := h.saveRequest(toProxy, h.scope.Contains("https", host, port, toProxy.URL.Path))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+
+	responce, err := h.roundTripHttp2(toProxy, host, port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+
+	err = h.rewriter.ApplyResponse(responce)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+
+	h.scripts.OnResponse(toProxy, responce, requestId)
+
+	if h.interceptor.MatchResponse(toProxy, responce) {
+		forward, err := h.interceptor.HoldResponse(toProxy, responce)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return err
+		}
+
+		if !forward {
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	responseCapture := repository.NewCapture(responce.Body, h.config.MaxCapturedSize)
+	responce.Body = responseCapture
+	defer responseCapture.Close()
+
+	for key, values := range responce.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(responce.StatusCode)
+
+	copyErr := copyFlushing(w, responce.Body)
+
+	for key, values := range responce.Trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+
+	// The response body has been streamed by now, so it can only be
+	// recorded once the stream is over.
+	_, err = h.saveResponse(requestId, responce)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return copyErr
+}
+
+// roundTripHttp2 forwards a stream over h2 when the origin supports it and
+// falls back to a pooled HTTP/1.1 connection otherwise.
+func (h *Handler) roundTripHttp2(req *http.Request, host, port string) (*http.Response, error) {
+	key := net.JoinHostPort(host, port)
+	upstream := h.http2
+
+	upstream.mutex.Lock()
+	cc, ok := upstream.conns[key]
+	http1Only := upstream.http1Only[key]
+	upstream.mutex.Unlock()
+
+	if ok && cc.CanTakeNewRequest() {
+		return upstream.roundTrip(cc, key, req)
+	}
+
+	if http1Only {
+		hostConnection, err := h.pool.Get("https", host, port)
+		if err != nil {
+			return nil, err
+		}
+
+		return h.roundTripHttp1(hostConnection, req)
+	}
+
+	connection, err := tlsConnect(h.dialer, host, port, []string{http2.NextProtoTLS, "http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+
+	if connection.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		upstream.mutex.Lock()
+		upstream.http1Only[key] = true
+		upstream.mutex.Unlock()
+
+		return h.roundTripHttp1(&upstreamConnection{
+			Conn:   connection,
+			reader: newReader(connection),
+			key:    "https://" + key,
+		}, req)
+	}
+
+	cc, err = upstream.transport.NewClientConn(connection)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	// Another stream may have dialed the origin meanwhile. Only one
+	// connection is kept, the other one is closed.
+	upstream.mutex.Lock()
+	existing, ok := upstream.conns[key]
+	if ok && existing.CanTakeNewRequest() {
+		upstream.mutex.Unlock()
+		cc.Close()
+		return upstream.roundTrip(existing, key, req)
+	}
+	upstream.conns[key] = cc
+	upstream.mutex.Unlock()
+
+	return upstream.roundTrip(cc, key, req)
+}
+
+func (u *http2Upstream) roundTrip(cc *http2.ClientConn, key string, req *http.Request) (*http.Response, error) {
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		u.mutex.Lock()
+		if u.conns[key] == cc {
+			delete(u.conns, key)
+		}
+		u.mutex.Unlock()
+	}
+
+	return resp, err
+}
+
+func (h *Handler) roundTripHttp1(hostConnection *upstreamConnection, req *http.Request) (*http.Response, error) {
+	req.Proto = "HTTP/1.1"
+	req.ProtoMajor = 1
+	req.ProtoMinor = 1
+	if req.ContentLength < 0 {
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	responce, err := sendRequest(hostConnection, req)
+	if err != nil {
+		hostConnection.Close()
+		return nil, err
+	}
+
+	responce.Body = &pooledBody{
+		ReadCloser: responce.Body,
+		connection: hostConnection,
+		pool:       h.pool,
+		reusable:   !responce.Close,
+	}
+
+	return responce, nil
+}
+
+// pooledBody hands its connection back to the pool once the body has been
+// read to the end.
+type pooledBody struct {
+	io.ReadCloser
+	connection *upstreamConnection
+	pool       *connectionPool
+	reusable   bool
+	done       bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.done = true
+	}
+
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	err := b.ReadCloser.Close()
+
+	if b.done && b.reusable {
+		b.pool.Put(b.connection)
+	} else {
+		b.connection.Close()
+	}
+
+	return err
+}
+
+func copyFlushing(w http.ResponseWriter, body io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 32<<10)
+
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			_, writeErr := w.Write(buffer[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
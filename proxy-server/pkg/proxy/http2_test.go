@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleStreamKeepsQuery(t *testing.T) {
+	handler, storage := newTestHandler(t, Config{})
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Origin-Proto", r.Proto)
+		w.Header().Set("X-Origin-Query", r.URL.RawQuery)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	// The test origin is not trusted by tlsConnect, so its h2 connection is
+	// handed to the upstream directly.
+	connection, err := tls.Dial("tcp", origin.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := handler.http2.transport.NewClientConn(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	host, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	handler.http2.conns[net.JoinHostPort(host, port)] = cc
+
+	req := httptest.NewRequest(http.MethodGet, "https://"+origin.Listener.Addr().String()+"/path?a=1;b=2", nil)
+	w := httptest.NewRecorder()
+
+	err = handler.handleStream(w, req, host, port, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Origin-Proto") != "HTTP/2.0" {
+		t.Fatalf("got %d over %s", w.Code, w.Header().Get("X-Origin-Proto"))
+	}
+
+	if query := w.Header().Get("X-Origin-Query"); query != "a=1;b=2" {
+		t.Errorf("origin got query %q", query)
+	}
+
+	requests, err := storage.requests.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || requests[0].GetParams["a"] == nil || requests[0].GetParams["b"] == nil {
+		t.Fatalf("recorded %d requests", len(requests))
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"proxy-server/pkg/hostmatch"
+	"proxy-server/pkg/repository"
+	"strconv"
+	"time"
+)
+
+// PassthroughConfig lists tunnels that must not be decrypted, for example
+// certificate pinned apps or hosts that may not be inspected. Hosts holds
+// globs and CIDRs, Ports matches any host on the given ports. A host is also
+// switched to passthrough after AutoAfter failed client handshakes, unless
+// AutoAfter is 0.
+type PassthroughConfig struct {
+	Hosts     []string
+	Ports     []int
+	AutoAfter int
+}
+
+func (h *Handler) isPassthrough(host, port string) bool {
+	if hostmatch.MatchAny(h.config.Passthrough.Hosts, host) {
+		return true
+	}
+
+	h.mutex.Lock()
+	auto := h.autoPassthrough[host]
+	h.mutex.Unlock()
+
+	if auto {
+		return true
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+
+	for _, elem := range h.config.Passthrough.Ports {
+		if elem == portNumber {
+			return true
+		}
+	}
+
+	return false
+}
+
+// passthrough splices a tunnel to its destination without looking inside
+// and records only how long it lasted and how much went each way.
+func (h *Handler) passthrough(clientConnection net.Conn, host, port string) error {
+	started := time.Now()
+
+	hostConnection, err := tcpConnect(h.dialer, host, port)
+	if err != nil {
+		return err
+	}
+
+	defer hostConnection.Close()
+
+	up, down, err := splice(clientConnection, hostConnection)
+
+	_, saveErr := h.tunnelSaver.Save(&repository.Tunnel{
+		Host:      host,
+		Port:      port,
+		BytesUp:   up,
+		BytesDown: down,
+		Started:   started,
+		Duration:  time.Since(started).Milliseconds(),
+	})
+	if saveErr != nil {
+		fmt.Println(saveErr)
+	}
+
+	return err
+}
+
+// recordHandshakeFailure counts a client that refused the intercepting
+// certificate for host and switches the host to passthrough once it keeps
+// happening, unless AutoAfter is 0. Handshakes that fail for other reasons,
+// such as a client that disconnects or does not speak TLS, are not counted,
+// and neither are tunnels whose destination is unknown.
+func (h *Handler) recordHandshakeFailure(host string, handshakeErr error) {
+	if host == "" || !isCertificateRejection(handshakeErr) {
+		return
+	}
+
+	pinned, err := h.pinningSaver.RecordFailure(host, handshakeErr.Error())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if h.config.Passthrough.AutoAfter <= 0 || pinned.Passthrough || pinned.Failures < h.config.Passthrough.AutoAfter {
+		return
+	}
+
+	fmt.Printf("Switching %s to passthrough after %d failed handshakes\n", host, pinned.Failures)
+
+	err = h.pinningSaver.SetPassthrough(host)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	h.mutex.Lock()
+	h.autoPassthrough[host] = true
+	h.mutex.Unlock()
+}
+
+// certificateRejections are the alerts clients send when they do not trust
+// the certificate they were offered.
+var certificateRejections = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unknown certificate authority": true,
+	"tls: unknown certificate":           true,
+}
+
+// isCertificateRejection reports whether a handshake failed because the
+// client sent one of certificateRejections. crypto/tls does not export its
+// alerts, they are told apart by their text.
+func isCertificateRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+
+	return certificateRejections[opErr.Err.Error()]
+}
+
+func loadAutoPassthrough(pinning repository.PinningSaver) map[string]bool {
+	res := make(map[string]bool)
+
+	hosts, err := pinning.List(0)
+	if err != nil {
+		fmt.Println(err)
+		return res
+	}
+
+	for _, host := range hosts {
+		if host.Passthrough {
+			res[host.Host] = true
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRecordHandshakeFailure(t *testing.T) {
+	handler, _ := newTestHandler(t, Config{
+		Passthrough: PassthroughConfig{AutoAfter: 2},
+	})
+
+	rejection := &net.OpError{Op: "remote error", Err: errors.New("tls: unknown certificate authority")}
+
+	// Tunnels without a destination name must not share one entry.
+	for i := 0; i < 3; i++ {
+		handler.recordHandshakeFailure("", rejection)
+		handler.recordHandshakeFailure("closed.example", errors.New("EOF"))
+		handler.recordHandshakeFailure("pinned.example", rejection)
+	}
+
+	pinned, err := handler.pinningSaver.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pinned) != 1 || pinned[0].Host != "pinned.example" || pinned[0].Failures != 3 {
+		t.Fatalf("recorded %+v", pinned)
+	}
+
+	if handler.isPassthrough("", "443") || handler.isPassthrough("closed.example", "443") {
+		t.Error("host switched to passthrough without being pinned")
+	}
+
+	if !handler.isPassthrough("pinned.example", "443") {
+		t.Error("pinned host was not switched to passthrough")
+	}
+}
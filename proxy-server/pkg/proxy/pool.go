@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"proxy-server/pkg/chain"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultMaxIdlePerHost = 4
+const DefaultPoolIdleTimeout = time.Second * 90
+
+type PoolConfig struct {
+	MaxIdlePerHost int
+	IdleTimeout    time.Duration
+}
+
+type PoolStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Idle   int   `json:"idle"`
+}
+
+type upstreamConnection struct {
+	net.Conn
+	reader    *bufio.Reader
+	key       string
+	reused    bool
+	idleSince time.Time
+}
+
+// connectionPool keeps idle upstream connections keyed by scheme and
+// host:port so that keep-alive clients do not pay a new TCP and TLS
+// handshake on every request.
+type connectionPool struct {
+	mutex  sync.Mutex
+	idle   map[string][]*upstreamConnection
+	config PoolConfig
+	dialer *chain.Dialer
+	hits   int64
+	misses int64
+}
+
+func newConnectionPool(config PoolConfig, dialer *chain.Dialer) *connectionPool {
+	return &connectionPool{
+		idle:   make(map[string][]*upstreamConnection),
+		config: config,
+		dialer: dialer,
+	}
+}
+
+func (p *connectionPool) Get(scheme, host, port string) (*upstreamConnection, error) {
+	key := scheme + "://" + net.JoinHostPort(host, port)
+
+	p.mutex.Lock()
+	p.prune(time.Now())
+	connections := p.idle[key]
+	if len(connections) != 0 {
+		connection := connections[len(connections)-1]
+		p.idle[key] = connections[:len(connections)-1]
+		p.mutex.Unlock()
+
+		atomic.AddInt64(&p.hits, 1)
+		connection.reused = true
+		return connection, nil
+	}
+	p.mutex.Unlock()
+
+	atomic.AddInt64(&p.misses, 1)
+	return p.Dial(scheme, host, port)
+}
+
+func (p *connectionPool) Dial(scheme, host, port string) (*upstreamConnection, error) {
+	var connection net.Conn
+	var err error
+	if scheme == "https" {
+		connection, err = tlsConnect(p.dialer, host, port, nil)
+	} else {
+		connection, err = tcpConnect(p.dialer, host, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamConnection{
+		Conn:   connection,
+		reader: newReader(connection),
+		key:    scheme + "://" + net.JoinHostPort(host, port),
+	}, nil
+}
+
+// Put returns a connection whose last response has been fully read. It is
+// closed instead when the pool for its host is already full.
+func (p *connectionPool) Put(connection *upstreamConnection) {
+	if p.config.MaxIdlePerHost <= 0 || connection.reader.Buffered() != 0 {
+		connection.Close()
+		return
+	}
+
+	now := time.Now()
+	connection.idleSince = now
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.prune(now)
+	if len(p.idle[connection.key]) >= p.config.MaxIdlePerHost {
+		connection.Close()
+		return
+	}
+
+	p.idle[connection.key] = append(p.idle[connection.key], connection)
+}
+
+func (p *connectionPool) Stats() PoolStats {
+	p.mutex.Lock()
+	idle := 0
+	for _, connections := range p.idle {
+		idle += len(connections)
+	}
+	p.mutex.Unlock()
+
+	return PoolStats{
+		Hits:   atomic.LoadInt64(&p.hits),
+		Misses: atomic.LoadInt64(&p.misses),
+		Idle:   idle,
+	}
+}
+
+// CloseIdle closes all idle connections.
+func (p *connectionPool) CloseIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, connections := range p.idle {
+		for _, connection := range connections {
+			connection.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// prune closes connections that have been idle for longer than the idle
+// timeout. It must be called with the mutex held.
+func (p *connectionPool) prune(now time.Time) {
+	for key, connections := range p.idle {
+		alive := connections[:0]
+		for _, connection := range connections {
+			if now.Sub(connection.idleSince) > p.config.IdleTimeout {
+				connection.Close()
+				continue
+			}
+			alive = append(alive, connection)
+		}
+
+		if len(alive) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = alive
+		}
+	}
+}
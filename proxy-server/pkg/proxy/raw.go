@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// kReaderSize is the buffer of the readers of client and upstream
+// connections. Message heads that fit in it are recorded as received.
+const kReaderSize = 64 << 10
+
+func newReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, kReaderSize)
+}
+
+// peekHead waits until reader holds a whole request or response head and
+// returns a copy of its bytes without consuming them, so it is then parsed
+// as usual. Heads larger than the buffer are not recorded, nil is returned.
+func peekHead(reader *bufio.Reader) ([]byte, error) {
+	for {
+		data, _ := reader.Peek(reader.Buffered())
+
+		end := headEnd(data)
+		if end > 0 {
+			return append([]byte(nil), data[:end]...), nil
+		}
+
+		if len(data) >= reader.Size() {
+			return nil, nil
+		}
+
+		_, err := reader.Peek(len(data) + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// headEnd returns the length of the head at the start of data, up to and
+// including the empty line after the headers, or -1 when it is incomplete.
+func headEnd(data []byte) int {
+	for i := 0; i < len(data); {
+		n := bytes.IndexByte(data[i:], '\n')
+		if n < 0 {
+			return -1
+		}
+
+		line := data[i : i+n]
+		i += n + 1
+
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return i
+		}
+	}
+
+	return -1
+}
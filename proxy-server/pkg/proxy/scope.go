@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"proxy-server/pkg/scope"
+)
+
+func (h *Handler) Scope() *scope.Scope {
+	return h.scope
+}
+
+// saveRequest records req unless it is out of scope and such traffic is
+// skipped. An empty id means nothing was recorded and the rest of the
+// exchange is not recorded either.
+func (h *Handler) saveRequest(req *http.Request, inScope bool) (string, error) {
+	if !inScope && !h.scope.Tags() {
+		return "", nil
+	}
+
+	id, err := h.requestSaver.Save(req)
+	if err != nil || inScope {
+		return id, err
+	}
+
+	return id, h.requestSaver.Tag(id, scope.Tag)
+}
+
+func (h *Handler) saveResponse(requestId string, resp *http.Response) (string, error) {
+	if requestId == "" {
+		return "", nil
+	}
+
+	return h.responseSaver.Save(requestId, resp)
+}
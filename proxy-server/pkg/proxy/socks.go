@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"proxy-server/pkg/socks"
+	"time"
+)
+
+// SocksConfig adds a user to the SOCKS5 listener when Username is set, next
+// to the users of AuthConfig.
+type SocksConfig struct {
+	Username string
+	Password string
+}
+
+const kSniffTimeout = time.Second
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+}
+
+func (h *Handler) HandleSocks(ctx context.Context, connection net.Conn) error {
+	if !h.isAllowed(connection) {
+		return fmt.Errorf("%s is not allowed to use the proxy", connection.RemoteAddr())
+	}
+
+	connection.SetReadDeadline(time.Now().Add(h.config.Timeout))
+
+	host, port, user, err := socks.Accept(connection, h.socksCredentials())
+	if err != nil {
+		return err
+	}
+
+	return h.handleSniffed(ctx, connection, host, port, user)
+}
+
+// handleSniffed looks at the first bytes of a tunnel. TLS is intercepted,
+// plain HTTP goes through the request loop and anything else, including
+// protocols where the server speaks first, is relayed untouched. An empty
+// host means the destination is unknown and has to be taken from the Host
+// header or the TLS server name.
+func (h *Handler) handleSniffed(ctx context.Context, clientConnection net.Conn, host, port, user string) error {
+	reader := newReader(clientConnection)
+	buffered := &bufferedConn{Conn: clientConnection, reader: reader}
+
+	clientConnection.SetReadDeadline(time.Now().Add(kSniffTimeout))
+	first, _ := reader.Peek(1)
+	clientConnection.SetReadDeadline(time.Now().Add(h.config.Timeout))
+
+	switch {
+	case len(first) != 0 && first[0] == 0x16:
+		if port == "" {
+			port = "443"
+		}
+		if host != "" && h.isPassthrough(host, port) {
+			return h.passthrough(buffered, host, port)
+		}
+		return h.intercept(ctx, buffered, host, port, user)
+	case len(first) != 0 && looksLikeHttp(reader):
+		target := ""
+		if host != "" {
+			target = net.JoinHostPort(host, port)
+		}
+		return h.serve(ctx, buffered, reader, nil, "http", target, user)
+	case host == "":
+		return errNoOriginalDestination
+	default:
+		return h.relayRaw(buffered, host, port)
+	}
+}
+
+func looksLikeHttp(reader *bufio.Reader) bool {
+	for _, method := range httpMethods {
+		prefix, _ := reader.Peek(len(method))
+		if bytes.Equal(prefix, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Handler) relayRaw(clientConnection net.Conn, host, port string) error {
+	hostConnection, err := tcpConnect(h.dialer, host, port)
+	if err != nil {
+		return err
+	}
+
+	defer hostConnection.Close()
+
+	_, _, err = splice(clientConnection, hostConnection)
+	return err
+}
+
+// splice copies bytes both ways until one side is done and reports how much
+// went up to the server and down to the client.
+func splice(clientConnection, hostConnection net.Conn) (int64, int64, error) {
+	clientConnection.SetReadDeadline(time.Time{})
+
+	var up int64
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		up, err = io.Copy(hostConnection, clientConnection)
+		if tcp, ok := hostConnection.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- err
+	}()
+
+	down, err := io.Copy(clientConnection, hostConnection)
+	clientConnection.SetReadDeadline(time.Now())
+
+	upErr := <-done
+	if err == nil && upErr != nil && !isClosed(upErr) {
+		err = upErr
+	}
+
+	return up, down, err
+}
+
+// bufferedConn is a connection whose first bytes have already been peeked
+// into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
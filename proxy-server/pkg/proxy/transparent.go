@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errNoOriginalDestination = errors.New("original destination is not available")
+
+// HandleTransparent serves a connection that was redirected to the proxy by
+// the firewall. The destination comes from SO_ORIGINAL_DST where available,
+// otherwise from the Host header or the TLS server name.
+func (h *Handler) HandleTransparent(ctx context.Context, connection net.Conn) error {
+	if !h.isAllowed(connection) {
+		return fmt.Errorf("%s is not allowed to use the proxy", connection.RemoteAddr())
+	}
+
+	connection.SetReadDeadline(time.Now().Add(h.config.Timeout))
+
+	host, port, err := originalDestination(connection)
+	if err != nil || isLocalAddress(connection, host, port) {
+		host, port = "", ""
+	}
+
+	return h.handleSniffed(ctx, connection, host, port, "")
+}
+
+// isLocalAddress reports whether the destination is the listener itself,
+// which is what SO_ORIGINAL_DST returns for connections that were not
+// redirected.
+func isLocalAddress(connection net.Conn, host, port string) bool {
+	local, ok := connection.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return net.JoinHostPort(host, port) == local.String()
+}
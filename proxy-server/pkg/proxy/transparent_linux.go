@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Netfilter options from linux/netfilter_ipv4.h and netfilter_ipv6.h.
+const kSoOriginalDst = 80
+const kIp6tSoOriginalDst = 80
+
+func originalDestination(connection net.Conn) (string, string, error) {
+	tcp, ok := connection.(*net.TCPConn)
+	if !ok {
+		return "", "", errNoOriginalDestination
+	}
+
+	local, ok := tcp.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", "", errNoOriginalDestination
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return "", "", err
+	}
+
+	var ip net.IP
+	var port uint16
+	var sockErr error
+
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in fits into the multicast request the
+			// kernel fills in.
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, kSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+
+			port = binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			return
+		}
+
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, kIp6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+
+		// The port is stored in network byte order.
+		port = binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		ip = net.IP(info.Addr.Addr[:])
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if sockErr != nil {
+		return "", "", sockErr
+	}
+
+	return ip.String(), strconv.Itoa(int(port)), nil
+}
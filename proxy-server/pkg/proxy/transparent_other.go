@@ -0,0 +1,9 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+func originalDestination(connection net.Conn) (string, string, error) {
+	return "", "", errNoOriginalDestination
+}
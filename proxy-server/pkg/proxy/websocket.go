@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"proxy-server/pkg/repository"
+	"proxy-server/pkg/websocket"
+	"time"
+)
+
+// handleWebSocket forwards an upgrade request on a dedicated upstream
+// connection and, once the server agrees, relays frames in both directions
+// until either side goes away.
+func (h *Handler) handleWebSocket(clientConnection net.Conn, clientReader *bufio.Reader, toProxy *http.Request, requestId, scheme, host, port string) error {
+	hostConnection, err := h.pool.Dial(scheme, host, port)
+	if err != nil {
+		return err
+	}
+
+	defer hostConnection.Close()
+
+	responce, err := sendRequest(hostConnection, toProxy)
+	if err != nil {
+		return err
+	}
+
+	if responce.StatusCode != http.StatusSwitchingProtocols {
+		capture := repository.NewCapture(responce.Body, h.config.MaxCapturedSize)
+		responce.Body = capture
+		defer capture.Close()
+
+		responce.Close = true
+		writeErr := writeResponce(responce, clientConnection)
+
+		_, err = h.saveResponse(requestId, responce)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return writeErr
+	}
+
+	_, err = h.saveResponse(requestId, responce)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	err = writeResponce(responce, clientConnection)
+	if err != nil {
+		return err
+	}
+
+	clientConnection.SetReadDeadline(time.Time{})
+
+	done := make(chan error, 2)
+	go func() {
+		done <- h.relayFrames(clientReader, hostConnection, requestId, repository.DirectionToServer)
+	}()
+	go func() {
+		done <- h.relayFrames(hostConnection.reader, clientConnection, requestId, repository.DirectionToClient)
+	}()
+
+	err = <-done
+
+	clientConnection.SetReadDeadline(time.Now())
+	hostConnection.Close()
+	<-done
+
+	if err != nil && !isClosed(err) {
+		return err
+	}
+
+	return nil
+}
+
+// relayFrames streams frames from src to dst as they arrive, so frames of any
+// size pass. At most MaxCapturedSize bytes of each message are recorded.
+func (h *Handler) relayFrames(src io.Reader, dst io.Writer, requestId, direction string) error {
+	var pending *repository.Message
+	payload := &cappedBuffer{limit: h.config.MaxCapturedSize}
+
+	for {
+		header, err := websocket.ReadHeader(src)
+		if err != nil {
+			return err
+		}
+
+		err = websocket.WriteHeader(dst, header)
+		if err != nil {
+			return err
+		}
+
+		if header.IsControl() {
+			control := &cappedBuffer{limit: h.config.MaxCapturedSize}
+
+			err = websocket.CopyPayload(dst, src, header, control)
+			if err != nil {
+				return err
+			}
+
+			h.saveMessage(requestId, &repository.Message{
+				Direction: direction,
+				Opcode:    int(header.Opcode),
+				Payload:   string(control.data),
+				Time:      time.Now(),
+			})
+			continue
+		}
+
+		if header.Opcode != websocket.OpContinuation {
+			pending = &repository.Message{
+				Direction: direction,
+				Opcode:    int(header.Opcode),
+				Time:      time.Now(),
+			}
+			payload.data = payload.data[:0]
+		}
+
+		var capture io.Writer
+		if pending != nil {
+			capture = payload
+		}
+
+		err = websocket.CopyPayload(dst, src, header, capture)
+		if err != nil {
+			return err
+		}
+
+		if pending != nil && header.Fin {
+			pending.Payload = string(payload.data)
+			h.saveMessage(requestId, pending)
+			pending = nil
+		}
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it and drops the rest.
+type cappedBuffer struct {
+	data  []byte
+	limit int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if left := b.limit - int64(len(b.data)); left > 0 {
+		if left < int64(len(p)) {
+			b.data = append(b.data, p[:left]...)
+		} else {
+			b.data = append(b.data, p...)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (h *Handler) saveMessage(requestId string, message *repository.Message) {
+	if requestId == "" {
+		return
+	}
+
+	_, err := h.messageSaver.Save(requestId, message)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections lists everything a project is made of, in an order that
+// imports requests before what refers to them.
+var Collections = []string{kRequests, kResponses, kMessages, kTunnels, kPinning, kRewriteRules, kTokens}
+
+// Archive reads and writes the raw documents of a backend with their ids,
+// so a project can be moved from one backend to another unchanged.
+type Archive interface {
+	Export(collection string, each func(document bson.Raw) error) error
+	// Import replaces the document with the same _id, so importing twice
+	// is harmless.
+	Import(collection string, document bson.Raw) error
+	// Flush writes what Import may have buffered.
+	Flush() error
+}
+
+type MongoArchive struct {
+	database *mongo.Database
+}
+
+func NewMongoArchive(conn *mongo.Client) Archive {
+	return &MongoArchive{
+		database: conn.Database(kDatabase),
+	}
+}
+
+func (a *MongoArchive) Export(collection string, each func(document bson.Raw) error) error {
+	ctx := context.Background()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := a.database.Collection(collection).Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		err = each(cursor.Current)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (a *MongoArchive) Import(collection string, document bson.Raw) error {
+	filter := bson.D{{Key: "_id", Value: document.Lookup("_id")}}
+	opts := options.Replace().SetUpsert(true)
+
+	_, err := a.database.Collection(collection).ReplaceOne(context.Background(), filter, document, opts)
+	return err
+}
+
+func (a *MongoArchive) Flush() error {
+	return nil
+}
+
+// sqliteImportBatch is how many imported documents share a transaction,
+// committing each one alone is slow.
+const sqliteImportBatch = 1000
+
+type SqliteArchive struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	pending int
+}
+
+func NewSqliteArchive(db *sql.DB) Archive {
+	return &SqliteArchive{
+		db: db,
+	}
+}
+
+func (a *SqliteArchive) Export(collection string, each func(document bson.Raw) error) error {
+	rows, err := a.db.Query("SELECT document FROM " + collection + " ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var document []byte
+
+		err = rows.Scan(&document)
+		if err != nil {
+			return err
+		}
+
+		err = each(document)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (a *SqliteArchive) Import(collection string, document bson.Raw) error {
+	if a.tx == nil {
+		tx, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+		a.tx = tx
+	}
+
+	err := newSqliteCollection(a.db, collection).put(a.tx, document)
+	if err != nil {
+		return err
+	}
+
+	a.pending++
+	if a.pending >= sqliteImportBatch {
+		return a.Flush()
+	}
+
+	return nil
+}
+
+func (a *SqliteArchive) Flush() error {
+	if a.tx == nil {
+		return nil
+	}
+
+	tx := a.tx
+	a.tx = nil
+	a.pending = 0
+
+	return tx.Commit()
+}
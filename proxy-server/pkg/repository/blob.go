@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultBodyThreshold is the body size above which bodies are offloaded,
+// well below the 16MB limit of a Mongo document.
+const DefaultBodyThreshold = 1 << 20
+
+// BlobStore keeps bodies outside of the documents, addressed by the hex
+// SHA-256 of their content, so equal bodies are stored once.
+type BlobStore interface {
+	// Put stores data under hash unless it is there already.
+	Put(hash string, data []byte) error
+	Open(hash string) (io.ReadCloser, error)
+}
+
+// BodyRef is stored instead of a body that was offloaded to a BlobStore.
+type BodyRef struct {
+	Sha256 string `json:"sha256" bson:"sha256"`
+	Size   int64  `json:"size" bson:"size"`
+}
+
+// BodyStore offloads the bodies larger than Threshold to Blobs. A nil
+// BodyStore keeps every body in its document.
+type BodyStore struct {
+	Blobs     BlobStore
+	Threshold int64
+}
+
+// put sets the body of a document, or a reference to it when it is large.
+func (b *BodyStore) put(value bson.M, body []byte) error {
+	if b == nil || b.Threshold <= 0 || int64(len(body)) <= b.Threshold {
+		value["body"] = body
+		return nil
+	}
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	err := b.Blobs.Put(hash, body)
+	if err != nil {
+		return err
+	}
+
+	value["body_ref"] = bson.M{"sha256": hash, "size": int64(len(body))}
+	return nil
+}
+
+// open returns a stored body, streaming it from Blobs when it was offloaded.
+func (b *BodyStore) open(body []byte, ref *BodyRef) (io.ReadCloser, error) {
+	if ref == nil {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	if b == nil {
+		return nil, errors.New("body " + ref.Sha256 + " is offloaded but no blob store is configured")
+	}
+
+	return b.Blobs.Open(ref.Sha256)
+}
+
+// DiskBlobStore keeps blobs as files named by their hash under dir, in
+// subdirectories named by its first two characters.
+type DiskBlobStore struct {
+	dir string
+}
+
+func NewDiskBlobStore(dir string) (BlobStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskBlobStore{dir: dir}, nil
+}
+
+func (s *DiskBlobStore) path(hash string) (string, error) {
+	if len(hash) != sha256.Size*2 {
+		return "", errors.New("invalid blob hash " + hash)
+	}
+
+	return filepath.Join(s.dir, hash[:2], hash), nil
+}
+
+func (s *DiskBlobStore) Put(hash string, data []byte) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// The blob is written aside and renamed, so a crash or a concurrent
+	// reader never sees it half written.
+	file, err := os.CreateTemp(filepath.Dir(path), hash+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+func (s *DiskBlobStore) Open(hash string) (io.ReadCloser, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+const kBodies = "bodies"
+
+// MongoBlobStore keeps blobs in the GridFS bucket "bodies", the files are
+// named by their hash.
+type MongoBlobStore struct {
+	// Uploads share the buffers of the bucket.
+	mutex  sync.Mutex
+	bucket *gridfs.Bucket
+}
+
+func NewMongoBlobStore(conn *mongo.Client) (BlobStore, error) {
+	bucket, err := gridfs.NewBucket(conn.Database(kDatabase), options.GridFSBucket().SetName(kBodies))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoBlobStore{bucket: bucket}, nil
+}
+
+func (s *MongoBlobStore) Put(hash string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ctx := context.Background()
+
+	cursor, err := s.bucket.FindContext(ctx, bson.D{{Key: "filename", Value: hash}}, options.GridFSFind().SetLimit(1))
+	if err != nil {
+		return err
+	}
+
+	found := cursor.Next(ctx)
+	err = cursor.Err()
+	cursor.Close(ctx)
+	if err != nil || found {
+		return err
+	}
+
+	_, err = s.bucket.UploadFromStream(hash, bytes.NewReader(data))
+	return err
+}
+
+func (s *MongoBlobStore) Open(hash string) (io.ReadCloser, error) {
+	stream, err := s.bucket.OpenDownloadStreamByName(hash)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MaxDecodedSize caps a decoded body, so a small compressed payload cannot
+// expand into gigabytes when it is viewed.
+const MaxDecodedSize = 64 << 20
+
+const kBase64 = "base64"
+
+// encodeBody returns body as it is put in JSON: as text when it is UTF-8
+// without NUL bytes, base64 otherwise. The second value names the encoding
+// and is empty for text.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) && bytes.IndexByte(body, 0) < 0 {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), kBase64
+}
+
+// jsonBody holds the body fields of a request or response in the API.
+type jsonBody struct {
+	Body                string `json:"body,omitempty"`
+	BodyEncoding        string `json:"body_encoding,omitempty"`
+	DecodedBody         string `json:"decoded_body,omitempty"`
+	DecodedBodyEncoding string `json:"decoded_body_encoding,omitempty"`
+	DecodeError         string `json:"decode_error,omitempty"`
+}
+
+func newJsonBody(body []byte, headers bson.M) jsonBody {
+	res := jsonBody{}
+	res.Body, res.BodyEncoding = encodeBody(body)
+
+	if len(contentEncodings(headers)) == 0 || len(body) == 0 {
+		return res
+	}
+
+	decoded, err := DecodeBody(body, headers)
+	if err != nil {
+		res.DecodeError = err.Error()
+		return res
+	}
+
+	res.DecodedBody, res.DecodedBodyEncoding = encodeBody(decoded)
+	return res
+}
+
+// jsonRawHead holds the head as received, when it was recorded.
+type jsonRawHead struct {
+	RawHead         string `json:"raw_head,omitempty"`
+	RawHeadEncoding string `json:"raw_head_encoding,omitempty"`
+}
+
+func newJsonRawHead(head []byte) jsonRawHead {
+	res := jsonRawHead{}
+	res.RawHead, res.RawHeadEncoding = encodeBody(head)
+
+	return res
+}
+
+func (r Request) MarshalJSON() ([]byte, error) {
+	type plain Request
+
+	return marshalJson(struct {
+		plain
+		jsonBody
+		jsonRawHead
+	}{plain(r), newJsonBody(r.Body, r.Headers), newJsonRawHead(StripProxyHeaders(r.RawHead))})
+}
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	type plain Response
+
+	return marshalJson(struct {
+		plain
+		jsonBody
+		jsonRawHead
+	}{plain(r), newJsonBody(r.Body, r.Headers), newJsonRawHead(r.RawHead)})
+}
+
+// marshalJson is json.Marshal without HTML escaping, like the API encoders.
+func marshalJson(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// DecodedBody returns the body with its Content-Encoding undone.
+func (r *Request) DecodedBody() ([]byte, error) {
+	return DecodeBody(r.Body, r.Headers)
+}
+
+// DecodedBody returns the body with its Content-Encoding undone.
+func (r *Response) DecodedBody() ([]byte, error) {
+	return DecodeBody(r.Body, r.Headers)
+}
+
+// DecodeBody undoes the codings listed in the Content-Encoding of headers,
+// the last applied first. Bodies without one are returned as they are.
+func DecodeBody(body []byte, headers bson.M) ([]byte, error) {
+	encodings := contentEncodings(headers)
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+
+		body, err = decode(body, encodings[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", encodings[i], err)
+		}
+	}
+
+	return body, nil
+}
+
+func contentEncodings(headers bson.M) []string {
+	res := make([]string, 0)
+
+	for _, value := range http.Header(fromBson(headers)).Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				res = append(res, encoding)
+			}
+		}
+	}
+
+	return res
+}
+
+func decode(body []byte, encoding string) ([]byte, error) {
+	var reader io.Reader
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		reader = gzipReader
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, some servers send it raw.
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+			break
+		}
+		defer zlibReader.Close()
+
+		reader = zlibReader
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zstdReader, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+
+		reader = zstdReader
+	default:
+		return nil, errors.New("unsupported content encoding")
+	}
+
+	res, err := io.ReadAll(io.LimitReader(reader, MaxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) > MaxDecodedSize {
+		return nil, fmt.Errorf("decoded body is larger than %d bytes", MaxDecodedSize)
+	}
+
+	return res, nil
+}
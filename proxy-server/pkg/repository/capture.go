@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+)
+
+// Capture wraps a body that is being streamed somewhere else and records at
+// most limit bytes of it. ResponseSaver implementations store the recorded
+// bytes instead of reading the body again.
+type Capture struct {
+	body      io.ReadCloser
+	buffer    bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func NewCapture(body io.ReadCloser, limit int64) *Capture {
+	return &Capture{
+		body:  body,
+		limit: limit,
+	}
+}
+
+func (c *Capture) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		c.record(p[:n])
+	}
+
+	return n, err
+}
+
+func (c *Capture) Close() error {
+	return c.body.Close()
+}
+
+func (c *Capture) Bytes() []byte {
+	return c.buffer.Bytes()
+}
+
+func (c *Capture) Truncated() bool {
+	return c.truncated
+}
+
+func (c *Capture) record(p []byte) {
+	left := c.limit - int64(c.buffer.Len())
+	if left < int64(len(p)) {
+		c.truncated = true
+		if left <= 0 {
+			return
+		}
+		p = p[:left]
+	}
+
+	c.buffer.Write(p)
+}
+
+// readBody returns a request or response body and whether it was cut short.
+// A Capture is consumed as recorded, anything else is read to the end.
+func readBody(body io.ReadCloser) ([]byte, bool, error) {
+	if capture, ok := body.(*Capture); ok {
+		return capture.Bytes(), capture.Truncated(), nil
+	}
+
+	if body == nil {
+		return nil, false, nil
+	}
+
+	res, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return res, false, nil
+}
@@ -0,0 +1,347 @@
+package repository
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultMemoryMaxEntries is how many requests, responses, messages and
+// tunnels the memory backend keeps of each before it drops the oldest.
+const DefaultMemoryMaxEntries = 10000
+
+// DefaultMemoryMaxBytes is how large the stored requests, responses, messages
+// and tunnels may get in total for each kind before the oldest are dropped.
+const DefaultMemoryMaxBytes = 256 << 20
+
+// memoryCollection keeps documents in insertion order, the way the Mongo
+// collections return them when sorted by _id. Documents are stored as BSON
+// and decoded on every read, so they come back exactly as from Mongo and
+// callers never share state with the store.
+type memoryCollection struct {
+	mutex      sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	documents  map[primitive.ObjectID]bson.Raw
+	order      []primitive.ObjectID
+}
+
+func newMemoryCollection(maxEntries int, maxBytes int64) *memoryCollection {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMemoryMaxEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMemoryMaxBytes
+	}
+
+	return &memoryCollection{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		documents:  make(map[primitive.ObjectID]bson.Raw),
+	}
+}
+
+// insert stores value under a new id. It returns the documents dropped to
+// stay within maxEntries and maxBytes, the new document itself is always
+// kept.
+func (c *memoryCollection) insert(value bson.M) (primitive.ObjectID, []bson.Raw, error) {
+	id := primitive.NewObjectID()
+	value["_id"] = id
+
+	document, err := bson.Marshal(value)
+	if err != nil {
+		return id, nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.documents[id] = document
+	c.order = append(c.order, id)
+	c.size += int64(len(document))
+
+	evicted := make([]bson.Raw, 0)
+	for len(c.order) > c.maxEntries || (len(c.order) > 1 && c.size > c.maxBytes) {
+		oldest := c.documents[c.order[0]]
+		evicted = append(evicted, oldest)
+		c.size -= int64(len(oldest))
+		delete(c.documents, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	return id, evicted, nil
+}
+
+func (c *memoryCollection) get(id string, value interface{}) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	document, ok := c.documents[objectId]
+	c.mutex.Unlock()
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	return bson.Unmarshal(document, value)
+}
+
+// update applies change to the document with id.
+func (c *memoryCollection) update(id string, change func(document bson.M)) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	document, ok := c.documents[objectId]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	value := bson.M{}
+	err = bson.Unmarshal(document, &value)
+	if err != nil {
+		return err
+	}
+
+	change(value)
+
+	updated, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	c.size += int64(len(updated) - len(document))
+	c.documents[objectId] = updated
+	return nil
+}
+
+// find returns up to limit documents accepted by match, all when limit is
+// not positive, newest or oldest first.
+func (c *memoryCollection) find(limit int64, newestFirst bool, match func(bson.Raw) bool) []bson.Raw {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	res := make([]bson.Raw, 0)
+
+	for i := range c.order {
+		id := c.order[i]
+		if newestFirst {
+			id = c.order[len(c.order)-1-i]
+		}
+
+		document := c.documents[id]
+		if match != nil && !match(document) {
+			continue
+		}
+
+		res = append(res, document)
+		if limit > 0 && int64(len(res)) >= limit {
+			break
+		}
+	}
+
+	return res
+}
+
+// MemoryRequestSaver keeps requests in memory, for running without Mongo and
+// for tests.
+type MemoryRequestSaver struct {
+	requests *memoryCollection
+	bodies   *BodyStore
+}
+
+// MemoryResponseSaver keeps responses in memory, indexed by their request.
+type MemoryResponseSaver struct {
+	responses *memoryCollection
+	bodies    *BodyStore
+
+	mutex     sync.Mutex
+	byRequest map[primitive.ObjectID]primitive.ObjectID
+}
+
+func NewMemoryRequestSaver(maxEntries int, maxBytes int64, bodies *BodyStore) RequestSaver {
+	return &MemoryRequestSaver{
+		requests: newMemoryCollection(maxEntries, maxBytes),
+		bodies:   bodies,
+	}
+}
+
+func NewMemoryResponseSaver(maxEntries int, maxBytes int64, bodies *BodyStore) ResponseSaver {
+	return &MemoryResponseSaver{
+		responses: newMemoryCollection(maxEntries, maxBytes),
+		bodies:    bodies,
+		byRequest: make(map[primitive.ObjectID]primitive.ObjectID),
+	}
+}
+
+func (s *MemoryRequestSaver) Save(req *http.Request) (string, error) {
+	value, err := requestDocument(req, s.bodies)
+	if err != nil {
+		return "", err
+	}
+
+	id, _, err := s.requests.insert(value)
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *MemoryRequestSaver) Get(id string) (*Request, error) {
+	value := &Request{}
+
+	err := s.requests.get(id, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MemoryRequestSaver) GetEncoded(id string) (*http.Request, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return toRequest(value, s.bodies)
+}
+
+func (s *MemoryRequestSaver) Body(id string) (io.ReadCloser, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bodies.open(value.Body, value.BodyRef)
+}
+
+func (s *MemoryRequestSaver) List(limit int64) ([]*Request, error) {
+	documents := s.requests.find(limit, true, nil)
+	res := make([]*Request, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Request{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+func (s *MemoryRequestSaver) Tag(id string, tag string) error {
+	return s.requests.update(id, func(document bson.M) {
+		tags, _ := document["tags"].(bson.A)
+		for _, elem := range tags {
+			if elem == tag {
+				return
+			}
+		}
+
+		document["tags"] = append(tags, tag)
+	})
+}
+
+func (s *MemoryResponseSaver) Save(requestId string, resp *http.Response) (string, error) {
+	value, err := responseDocument(requestId, resp, s.bodies)
+	if err != nil {
+		return "", err
+	}
+
+	id, evicted, err := s.responses.insert(value)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Like the Mongo lookup, the first response of a request is the one
+	// found by GetByRequest.
+	requestObjectId := value["request_id"].(primitive.ObjectID)
+	if _, ok := s.byRequest[requestObjectId]; !ok {
+		s.byRequest[requestObjectId] = id
+	}
+
+	for _, document := range evicted {
+		requestObjectId, ok := document.Lookup("request_id").ObjectIDOK()
+		if ok && s.byRequest[requestObjectId] == document.Lookup("_id").ObjectID() {
+			delete(s.byRequest, requestObjectId)
+		}
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *MemoryResponseSaver) Get(id string) (*Response, error) {
+	value := &Response{}
+
+	err := s.responses.get(id, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MemoryResponseSaver) Body(id string) (io.ReadCloser, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bodies.open(value.Body, value.BodyRef)
+}
+
+func (s *MemoryResponseSaver) GetByRequest(requestId string) (*Response, error) {
+	objectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	id, ok := s.byRequest[objectId]
+	s.mutex.Unlock()
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return s.Get(id.Hex())
+}
+
+func (s *MemoryResponseSaver) List(limit int64) ([]*Response, error) {
+	documents := s.responses.find(limit, true, nil)
+	res := make([]*Response, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Response{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
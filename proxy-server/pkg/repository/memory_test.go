@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/path?a=1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+	return req
+}
+
+func newTestResponse(body string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestMemoryRequestSaverRoundTrip(t *testing.T) {
+	saver := NewMemoryRequestSaver(10, 1<<20, nil)
+
+	id, err := saver.Save(newTestRequest("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := saver.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value.Method != http.MethodPost || value.Host != "example.com" || value.Path != "/path" {
+		t.Errorf("got %s %s%s", value.Method, value.Host, value.Path)
+	}
+
+	body, err := saver.Body(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	data, _ := io.ReadAll(body)
+	if string(data) != "hello" {
+		t.Errorf("body is %q", data)
+	}
+
+	err = saver.Tag(id, "out-of-scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = saver.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(value.Tags) != 1 || value.Tags[0] != "out-of-scope" {
+		t.Errorf("tags are %v", value.Tags)
+	}
+}
+
+func TestMemoryRequestSaverDropsOldestEntries(t *testing.T) {
+	saver := NewMemoryRequestSaver(2, 1<<20, nil)
+
+	ids := make([]string, 0)
+	for _, body := range []string{"a", "b", "c"} {
+		id, err := saver.Save(newTestRequest(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	_, err := saver.Get(ids[0])
+	if err == nil {
+		t.Error("oldest request was kept")
+	}
+
+	list, err := saver.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[0].Id.Hex() != ids[2] || list[1].Id.Hex() != ids[1] {
+		t.Errorf("list has %d requests", len(list))
+	}
+}
+
+func TestMemoryRequestSaverDropsOldestBytes(t *testing.T) {
+	saver := NewMemoryRequestSaver(100, 3000, nil)
+
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		id, err := saver.Save(newTestRequest(strings.Repeat("x", 1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	_, err := saver.Get(ids[0])
+	if err == nil {
+		t.Error("oldest request was kept beyond the byte limit")
+	}
+
+	_, err = saver.Get(ids[2])
+	if err != nil {
+		t.Error("newest request was dropped")
+	}
+
+	// A single record larger than the limit is still kept.
+	id, err := saver.Save(newTestRequest(strings.Repeat("x", 5000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = saver.Get(id)
+	if err != nil {
+		t.Error("oversized request was dropped")
+	}
+
+	list, _ := saver.List(0)
+	if len(list) != 1 {
+		t.Errorf("list has %d requests", len(list))
+	}
+}
+
+func TestMemoryResponseSaverByRequest(t *testing.T) {
+	requests := NewMemoryRequestSaver(10, 1<<20, nil)
+	responses := NewMemoryResponseSaver(1, 1<<20, nil)
+
+	first, err := requests.Save(newTestRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := requests.Save(newTestRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = responses.Save(first, newTestResponse("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := responses.GetByRequest(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value.Code != http.StatusOK || string(value.Body) != "one" {
+		t.Errorf("got %d %q", value.Code, value.Body)
+	}
+
+	_, err = responses.Save(second, newTestResponse("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = responses.GetByRequest(first)
+	if err == nil {
+		t.Error("dropped response is still found by its request")
+	}
+
+	_, err = responses.GetByRequest(second)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveLeavesRequestUntouched(t *testing.T) {
+	saver := NewMemoryRequestSaver(10, 1<<20, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/path?a=1;b=2", strings.NewReader("c=3&d=4"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	id, err := saver.Save(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.URL.RawQuery != "a=1;b=2" || req.Form != nil {
+		t.Errorf("query became %q", req.URL.RawQuery)
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "c=3&d=4" {
+		t.Errorf("body became %q", body)
+	}
+
+	value, err := saver.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(value.GetParams) != 2 || len(value.PostParams) != 2 {
+		t.Errorf("recorded %v and %v", value.GetParams, value.PostParams)
+	}
+}
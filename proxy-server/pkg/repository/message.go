@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MessageSaver stores WebSocket messages relayed over an upgraded
+// connection. Messages are linked to the request that opened it.
+type MessageSaver interface {
+	Save(requestId string, message *Message) (string, error)
+	Get(id string) (*Message, error)
+	ListByRequest(requestId string, limit int64) ([]*Message, error)
+}
+
+const (
+	DirectionToServer = "to_server"
+	DirectionToClient = "to_client"
+)
+
+type Message struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	RequestId primitive.ObjectID `json:"request_id" bson:"request_id"`
+	Direction string             `json:"direction"`
+	Opcode    int                `json:"opcode"`
+	Payload   string             `json:"payload"`
+	Time      time.Time          `json:"time"`
+}
+
+const kMessages = "messages"
+
+type MongoMessageSaver struct {
+	messages *mongo.Collection
+}
+
+func NewMongoMessageSaver(conn *mongo.Client) MessageSaver {
+	return &MongoMessageSaver{
+		messages: conn.Database(kDatabase).Collection(kMessages),
+	}
+}
+
+func (s *MongoMessageSaver) Save(requestId string, message *Message) (string, error) {
+	requestObjectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.messages.InsertOne(context.Background(), bson.M{
+		"request_id": requestObjectId,
+		"direction":  message.Direction,
+		"opcode":     message.Opcode,
+		"payload":    message.Payload,
+		"time":       message.Time,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+func (s *MongoMessageSaver) Get(id string) (*Message, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	res := s.messages.FindOne(context.Background(), bson.D{{Key: "_id", Value: objectId}})
+	value := &Message{}
+
+	err = res.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MongoMessageSaver) ListByRequest(requestId string, limit int64) ([]*Message, error) {
+	objectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	opts := options.Find().SetLimit(limit).SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := s.messages.Find(ctx, bson.D{{Key: "request_id", Value: objectId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Message, 0, limit/2)
+
+	err = cursor.All(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type MemoryMessageSaver struct {
+	messages *memoryCollection
+}
+
+func NewMemoryMessageSaver(maxEntries int, maxBytes int64) MessageSaver {
+	return &MemoryMessageSaver{
+		messages: newMemoryCollection(maxEntries, maxBytes),
+	}
+}
+
+func (s *MemoryMessageSaver) Save(requestId string, message *Message) (string, error) {
+	requestObjectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return "", err
+	}
+
+	id, _, err := s.messages.insert(bson.M{
+		"request_id": requestObjectId,
+		"direction":  message.Direction,
+		"opcode":     message.Opcode,
+		"payload":    message.Payload,
+		"time":       message.Time,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *MemoryMessageSaver) Get(id string) (*Message, error) {
+	value := &Message{}
+
+	err := s.messages.get(id, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MemoryMessageSaver) ListByRequest(requestId string, limit int64) ([]*Message, error) {
+	objectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := s.messages.find(limit, false, func(document bson.Raw) bool {
+		value, ok := document.Lookup("request_id").ObjectIDOK()
+		return ok && value == objectId
+	})
+
+	res := make([]*Message, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Message{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+type SqliteMessageSaver struct {
+	messages *sqliteCollection
+}
+
+func NewSqliteMessageSaver(db *sql.DB) MessageSaver {
+	return &SqliteMessageSaver{
+		messages: newSqliteCollection(db, kMessages),
+	}
+}
+
+func (s *SqliteMessageSaver) Save(requestId string, message *Message) (string, error) {
+	requestObjectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := s.messages.insert(bson.M{
+		"request_id": requestObjectId,
+		"direction":  message.Direction,
+		"opcode":     message.Opcode,
+		"payload":    message.Payload,
+		"time":       message.Time,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *SqliteMessageSaver) Get(id string) (*Message, error) {
+	key, err := objectIdKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Message{}
+
+	err = s.messages.get(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqliteMessageSaver) ListByRequest(requestId string, limit int64) ([]*Message, error) {
+	key, err := objectIdKey(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := s.messages.find("request_id = ?", []interface{}{key}, "id", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Message, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Message{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
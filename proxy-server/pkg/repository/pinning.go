@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PinningSaver keeps track of hosts whose clients refused the intercepting
+// certificate, which usually means the app pins its certificates.
+type PinningSaver interface {
+	RecordFailure(host string, reason string) (*PinnedHost, error)
+	SetPassthrough(host string) error
+	List(limit int64) ([]*PinnedHost, error)
+}
+
+type PinnedHost struct {
+	Host        string    `json:"host" bson:"_id"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error" bson:"last_error"`
+	LastFailure time.Time `json:"last_failure" bson:"last_failure"`
+	Passthrough bool      `json:"passthrough"`
+	SwitchedAt  time.Time `json:"switched_at,omitempty" bson:"switched_at,omitempty"`
+}
+
+const kPinning = "pinning"
+
+type MongoPinningSaver struct {
+	hosts *mongo.Collection
+}
+
+func NewMongoPinningSaver(conn *mongo.Client) PinningSaver {
+	return &MongoPinningSaver{
+		hosts: conn.Database(kDatabase).Collection(kPinning),
+	}
+}
+
+// RecordFailure counts one more failed handshake for host and returns the
+// updated record.
+func (s *MongoPinningSaver) RecordFailure(host string, reason string) (*PinnedHost, error) {
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"last_error": reason, "last_failure": time.Now()},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	res := s.hosts.FindOneAndUpdate(context.Background(), bson.D{{Key: "_id", Value: host}}, update, opts)
+	value := &PinnedHost{}
+
+	err := res.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MongoPinningSaver) SetPassthrough(host string) error {
+	update := bson.M{
+		"$set": bson.M{"passthrough": true, "switched_at": time.Now()},
+	}
+
+	_, err := s.hosts.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: host}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoPinningSaver) List(limit int64) ([]*PinnedHost, error) {
+	ctx := context.Background()
+
+	opts := options.Find().SetLimit(limit).SetSort(bson.D{{Key: "last_failure", Value: -1}})
+	cursor, err := s.hosts.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*PinnedHost, 0, limit/2)
+
+	err = cursor.All(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type MemoryPinningSaver struct {
+	mutex sync.Mutex
+	hosts map[string]*PinnedHost
+}
+
+func NewMemoryPinningSaver() PinningSaver {
+	return &MemoryPinningSaver{
+		hosts: make(map[string]*PinnedHost),
+	}
+}
+
+func (s *MemoryPinningSaver) RecordFailure(host string, reason string) (*PinnedHost, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.hosts[host]
+	if !ok {
+		value = &PinnedHost{Host: host}
+		s.hosts[host] = value
+	}
+
+	value.Failures++
+	value.LastError = reason
+	value.LastFailure = time.Now()
+
+	res := *value
+	return &res, nil
+}
+
+func (s *MemoryPinningSaver) SetPassthrough(host string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.hosts[host]
+	if !ok {
+		value = &PinnedHost{Host: host}
+		s.hosts[host] = value
+	}
+
+	value.Passthrough = true
+	value.SwitchedAt = time.Now()
+
+	return nil
+}
+
+func (s *MemoryPinningSaver) List(limit int64) ([]*PinnedHost, error) {
+	s.mutex.Lock()
+	res := make([]*PinnedHost, 0, len(s.hosts))
+	for _, value := range s.hosts {
+		host := *value
+		res = append(res, &host)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastFailure.After(res[j].LastFailure)
+	})
+
+	if limit > 0 && int64(len(res)) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
+
+type SqlitePinningSaver struct {
+	hosts *sqliteCollection
+}
+
+func NewSqlitePinningSaver(db *sql.DB) PinningSaver {
+	return &SqlitePinningSaver{
+		hosts: newSqliteCollection(db, kPinning),
+	}
+}
+
+func (s *SqlitePinningSaver) RecordFailure(host string, reason string) (*PinnedHost, error) {
+	err := s.hosts.update(host, true, func(document bson.M) {
+		switch failures := document["failures"].(type) {
+		case int32:
+			document["failures"] = failures + 1
+		case int64:
+			document["failures"] = failures + 1
+		default:
+			document["failures"] = int32(1)
+		}
+		document["last_error"] = reason
+		document["last_failure"] = time.Now()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value := &PinnedHost{}
+
+	err = s.hosts.get(host, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqlitePinningSaver) SetPassthrough(host string) error {
+	return s.hosts.update(host, true, func(document bson.M) {
+		document["passthrough"] = true
+		document["switched_at"] = time.Now()
+	})
+}
+
+func (s *SqlitePinningSaver) List(limit int64) ([]*PinnedHost, error) {
+	documents, err := s.hosts.find("", nil, "last_failure DESC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*PinnedHost, 0, len(documents))
+
+	for _, document := range documents {
+		value := &PinnedHost{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
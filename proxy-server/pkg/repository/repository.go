@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
@@ -18,13 +19,17 @@ type RequestSaver interface {
 	Save(*http.Request) (string, error)
 	Get(id string) (*Request, error)
 	GetEncoded(id string) (*http.Request, error)
+	// Body streams the body of a request, also when it was offloaded.
+	Body(id string) (io.ReadCloser, error)
 	List(limit int64) ([]*Request, error)
+	Tag(id string, tag string) error
 }
 
 type ResponseSaver interface {
 	Save(requestId string, resp *http.Response) (string, error)
 	Get(id string) (*Response, error)
 	GetByRequest(requestId string) (*Response, error)
+	Body(id string) (io.ReadCloser, error)
 	List(limit int64) ([]*Response, error)
 }
 
@@ -37,10 +42,15 @@ type Request struct {
 	Method     string             `json:"method"`
 	Path       string             `json:"path"`
 	Cookies    map[string]string  `json:"cookies"`
-	Body       string             `json:"body,omitempty" bson:"body,omitempty"`
+	Body       []byte             `json:"-" bson:"body,omitempty"`
+	BodyRef    *BodyRef           `json:"body_ref,omitempty" bson:"body_ref,omitempty"`
+	Truncated  bool               `json:"truncated,omitempty" bson:"truncated,omitempty"`
 	Headers    bson.M             `json:"headers"`
 	GetParams  bson.M             `json:"get_params" bson:"get_params"`
 	PostParams bson.M             `json:"post_params" bson:"post_params"`
+	Tags       []string           `json:"tags,omitempty" bson:"tags,omitempty"`
+	User       string             `json:"user,omitempty" bson:"user,omitempty"`
+	RawHead    []byte             `json:"-" bson:"raw_head,omitempty"`
 }
 
 type Response struct {
@@ -48,8 +58,11 @@ type Response struct {
 	RequestId primitive.ObjectID `json:"request_id" bson:"request_id"`
 	Code      int                `json:"code"`
 	Message   string             `json:"message"`
-	Body      string             `json:"body,omitempty" bson:"body,omitempty"`
+	Body      []byte             `json:"-" bson:"body,omitempty"`
+	BodyRef   *BodyRef           `json:"body_ref,omitempty" bson:"body_ref,omitempty"`
+	Truncated bool               `json:"truncated,omitempty" bson:"truncated,omitempty"`
 	Headers   bson.M             `json:"headers"`
+	RawHead   []byte             `json:"-" bson:"raw_head,omitempty"`
 }
 
 const kRequests = "requests"
@@ -57,34 +70,140 @@ const kResponses = "responses"
 
 type MongoRequestSaver struct {
 	requests *mongo.Collection
+	bodies   *BodyStore
 }
 
 type MongoResponseSaver struct {
 	responses *mongo.Collection
+	bodies    *BodyStore
 }
 
-func NewMongoRequestSaver(conn *mongo.Client) RequestSaver {
+func NewMongoRequestSaver(conn *mongo.Client, bodies *BodyStore) RequestSaver {
 	return &MongoRequestSaver{
 		requests: conn.Database(kDatabase).Collection(kRequests),
+		bodies:   bodies,
 	}
 }
 
-func NewMongoResponseSaver(conn *mongo.Client) ResponseSaver {
+func NewMongoResponseSaver(conn *mongo.Client, bodies *BodyStore) ResponseSaver {
 	return &MongoResponseSaver{
 		responses: conn.Database(kDatabase).Collection(kResponses),
+		bodies:    bodies,
 	}
 }
 
+type userKey struct{}
+
+// WithUser attributes req to the authenticated proxy user, Save stores the
+// name with the request.
+func WithUser(req *http.Request, user string) *http.Request {
+	if user == "" {
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+func UserOf(req *http.Request) string {
+	user, _ := req.Context().Value(userKey{}).(string)
+	return user
+}
+
+type rawHeadKey struct{}
+
+type rawResponseHeadKey struct{}
+
+// WithRawHead keeps head, the request line and headers exactly as the client
+// sent them, with req. Save stores it next to the parsed request. Proxy-*
+// headers are meant for the proxy, they carry the client's credentials and
+// are left out.
+func WithRawHead(req *http.Request, head []byte) *http.Request {
+	if head == nil {
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), rawHeadKey{}, StripProxyHeaders(head)))
+}
+
+// StripProxyHeaders returns head without its Proxy-* header lines and their
+// continuation lines, everything else is kept byte for byte.
+func StripProxyHeaders(head []byte) []byte {
+	res := make([]byte, 0, len(head))
+	skipping := false
+
+	for i, rest := 0, head; len(rest) != 0; i++ {
+		line := rest
+		if n := bytes.IndexByte(rest, '\n'); n >= 0 {
+			line = rest[:n+1]
+		}
+		rest = rest[len(line):]
+
+		// The first line is the request line, lines starting with
+		// whitespace continue the previous header.
+		if i != 0 && len(line) != 0 && line[0] != ' ' && line[0] != '\t' {
+			skipping = len(line) >= 6 && strings.EqualFold(string(line[:6]), "proxy-")
+		}
+
+		if !skipping {
+			res = append(res, line...)
+		}
+	}
+
+	return res
+}
+
+func RawHeadOf(req *http.Request) []byte {
+	head, _ := req.Context().Value(rawHeadKey{}).([]byte)
+	return head
+}
+
+// SetRawResponseHead keeps head, the status line and headers exactly as the
+// server sent them, with resp. It is kept on the request of resp, which is
+// replaced by a copy.
+func SetRawResponseHead(resp *http.Response, head []byte) {
+	if head == nil || resp.Request == nil {
+		return
+	}
+
+	resp.Request = resp.Request.WithContext(context.WithValue(resp.Request.Context(), rawResponseHeadKey{}, head))
+}
+
+func RawResponseHeadOf(resp *http.Response) []byte {
+	if resp.Request == nil {
+		return nil
+	}
+
+	head, _ := resp.Request.Context().Value(rawResponseHeadKey{}).([]byte)
+	return head
+}
+
 func (s *MongoRequestSaver) Save(req *http.Request) (string, error) {
-	body, err := io.ReadAll(req.Body)
+	value, err := requestDocument(req, s.bodies)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.requests.InsertOne(context.Background(), value)
 	if err != nil {
 		return "", err
 	}
 
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+// requestDocument is what every backend stores for req. The body is read
+// and put back, large ones are offloaded to bodies.
+func requestDocument(req *http.Request, bodies *BodyStore) (bson.M, error) {
+	body, truncated, err := readBody(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	req.Body = io.NopCloser(bytes.NewReader(body))
 
-	req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, ";", "&")
-	rawQuery := toBson(req.URL.Query())
+	// req is still to be sent, so its query is parsed from a copy.
+	query, _ := url.ParseQuery(strings.ReplaceAll(req.URL.RawQuery, ";", "&"))
+	rawQuery := toBson(query)
 
 	headers := toBson(req.Header)
 	delete(headers, "Cookie")
@@ -104,35 +223,51 @@ func (s *MongoRequestSaver) Save(req *http.Request) (string, error) {
 		"headers":    headers,
 		"cookies":    cookieMap,
 	}
+	if truncated {
+		value["truncated"] = true
+	}
+	if user := UserOf(req); user != "" {
+		value["user"] = user
+	}
+	if head := RawHeadOf(req); head != nil {
+		value["raw_head"] = head
+	}
 
-	postParams, err := parsePostParams(req)
+	postParams, err := parsePostParams(req, body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(postParams) != 0 {
 		value["post_params"] = postParams
-		req.Body = io.NopCloser(bytes.NewReader(body))
-	} else {
-		if req.Body != nil {
-			value["body"] = string(body)
+	}
+
+	// Forms keep their body too, the params lose its order and encoding.
+	if req.Body != nil {
+		err = bodies.put(value, body)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	res, err := s.requests.InsertOne(context.Background(), value)
+	return value, nil
+}
+
+func (s *MongoRequestSaver) GetEncoded(id string) (*http.Request, error) {
+	value, err := s.Get(id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+	return toRequest(value, s.bodies)
 }
 
-func (s *MongoRequestSaver) GetEncoded(id string) (*http.Request, error) {
+func (s *MongoRequestSaver) Body(id string) (io.ReadCloser, error) {
 	value, err := s.Get(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return toRequest(value)
+	return s.bodies.open(value.Body, value.BodyRef)
 }
 
 func (s *MongoRequestSaver) Get(id string) (*Request, error) {
@@ -152,6 +287,20 @@ func (s *MongoRequestSaver) Get(id string) (*Request, error) {
 	return value, nil
 }
 
+func (s *MongoRequestSaver) Tag(id string, tag string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{
+		"$addToSet": bson.M{"tags": tag},
+	}
+
+	_, err = s.requests.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: objectId}}, update)
+	return err
+}
+
 func (s *MongoRequestSaver) List(limit int64) ([]*Request, error) {
 	ctx := context.Background()
 
@@ -171,17 +320,30 @@ func (s *MongoRequestSaver) List(limit int64) ([]*Request, error) {
 	return res, nil
 }
 
-func parsePostParams(req *http.Request) (bson.M, error) {
+// parsePostParams reads the form in body the way req.ParseForm would, but
+// leaves req and its query alone.
+func parsePostParams(req *http.Request, body []byte) (bson.M, error) {
 	if req.Body == nil {
 		return nil, nil
 	}
 
-	err := req.ParseForm()
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, nil
+	}
+
+	values, err := url.ParseQuery(string(body))
 	if err != nil {
 		return nil, err
 	}
 
-	return toBson(req.PostForm), nil
+	return toBson(values), nil
 }
 
 func toBson(values map[string][]string) bson.M {
@@ -197,7 +359,7 @@ func toBson(values map[string][]string) bson.M {
 	return res
 }
 
-func toRequest(data *Request) (*http.Request, error) {
+func toRequest(data *Request, bodies *BodyStore) (*http.Request, error) {
 	res, err := http.NewRequest(data.Method, data.Scheme+"://"+data.Host+data.Path, nil)
 	if err != nil {
 		return nil, err
@@ -210,18 +372,22 @@ func toRequest(data *Request) (*http.Request, error) {
 		res.AddCookie(&http.Cookie{Name: key, Value: value})
 	}
 	res.URL.RawQuery = url.Values(fromBson(data.GetParams)).Encode()
-	res.Body = getBody(res, data)
+
+	res.Body, err = getBody(res, data, bodies)
+	if err != nil {
+		return nil, err
+	}
 
 	return res, nil
 }
 
-func getBody(req *http.Request, data *Request) io.ReadCloser {
+func getBody(req *http.Request, data *Request, bodies *BodyStore) (io.ReadCloser, error) {
 	if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
 		var params url.Values = fromBson(data.PostParams)
-		return io.NopCloser(strings.NewReader(params.Encode()))
+		return io.NopCloser(strings.NewReader(params.Encode())), nil
 	}
 
-	return io.NopCloser(strings.NewReader(data.Body))
+	return bodies.open(data.Body, data.BodyRef)
 }
 
 func fromBson(values bson.M) map[string][]string {
@@ -252,30 +418,53 @@ func fromBson(values bson.M) map[string][]string {
 }
 
 func (s *MongoResponseSaver) Save(requestId string, resp *http.Response) (string, error) {
-	requestObjectId, err := primitive.ObjectIDFromHex(requestId)
+	value, err := responseDocument(requestId, resp, s.bodies)
 	if err != nil {
 		return "", err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	res, err := s.responses.InsertOne(context.Background(), value)
 	if err != nil {
 		return "", err
 	}
 
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+// responseDocument is what every backend stores for resp. The body is read
+// and put back, large ones are offloaded to bodies.
+func responseDocument(requestId string, resp *http.Response, bodies *BodyStore) (bson.M, error) {
+	requestObjectId, err := primitive.ObjectIDFromHex(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	body, truncated, err := readBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	resp.Body = io.NopCloser(bytes.NewReader(body))
 
-	res, err := s.responses.InsertOne(context.Background(), bson.M{
+	value := bson.M{
 		"code":       resp.StatusCode,
 		"message":    resp.Status[strings.Index(resp.Status, " ")+1:],
 		"headers":    toBson(resp.Header),
 		"request_id": requestObjectId,
-		"body":       string(body),
-	})
+	}
+	if truncated {
+		value["truncated"] = true
+	}
+	if head := RawResponseHeadOf(resp); head != nil {
+		value["raw_head"] = head
+	}
+
+	err = bodies.put(value, body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+	return value, nil
 }
 
 func (s *MongoResponseSaver) Get(id string) (*Response, error) {
@@ -295,6 +484,15 @@ func (s *MongoResponseSaver) Get(id string) (*Response, error) {
 	return value, nil
 }
 
+func (s *MongoResponseSaver) Body(id string) (io.ReadCloser, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bodies.open(value.Body, value.BodyRef)
+}
+
 func (s *MongoResponseSaver) GetByRequest(requestId string) (*Response, error) {
 	objectId, err := primitive.ObjectIDFromHex(requestId)
 	if err != nil {
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RewriteSaver stores the ordered match-and-replace rules of the proxy.
+type RewriteSaver interface {
+	Replace(rules []*RewriteRule) error
+	List() ([]*RewriteRule, error)
+}
+
+// RewriteRule replaces Match with Replace in one location of every message.
+// Match is a regular expression when Regex is set, Replace may then refer to
+// groups as $1 or ${name}.
+type RewriteRule struct {
+	Id       primitive.ObjectID `json:"id" bson:"_id"`
+	Location string             `json:"location"`
+	Match    string             `json:"match"`
+	Replace  string             `json:"replace"`
+	Regex    bool               `json:"regex,omitempty"`
+	Disabled bool               `json:"disabled,omitempty"`
+	Comment  string             `json:"comment,omitempty" bson:"comment,omitempty"`
+}
+
+const kRewriteRules = "rewrite_rules"
+
+type MongoRewriteSaver struct {
+	rules *mongo.Collection
+}
+
+func NewMongoRewriteSaver(conn *mongo.Client) RewriteSaver {
+	return &MongoRewriteSaver{
+		rules: conn.Database(kDatabase).Collection(kRewriteRules),
+	}
+}
+
+// Replace swaps the stored rule set for rules, keeping their order. Rules
+// without an id get a new one. The rules are written to a collection of
+// their own which then takes the place of the old one in a single rename, so
+// a failure leaves the previous rules in place.
+func (s *MongoRewriteSaver) Replace(rules []*RewriteRule) error {
+	ctx := context.Background()
+
+	documents := make([]interface{}, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Id.IsZero() {
+			rule.Id = primitive.NewObjectID()
+		}
+
+		documents = append(documents, bson.M{
+			"_id":      rule.Id,
+			"position": i,
+			"location": rule.Location,
+			"match":    rule.Match,
+			"replace":  rule.Replace,
+			"regex":    rule.Regex,
+			"disabled": rule.Disabled,
+			"comment":  rule.Comment,
+		})
+	}
+
+	database := s.rules.Database()
+	next := database.Collection(kRewriteRules + "_" + primitive.NewObjectID().Hex())
+
+	var err error
+	if len(documents) == 0 {
+		err = database.CreateCollection(ctx, next.Name())
+	} else {
+		_, err = next.InsertMany(ctx, documents)
+	}
+	if err != nil {
+		next.Drop(ctx)
+		return err
+	}
+
+	err = database.Client().Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: database.Name() + "." + next.Name()},
+		{Key: "to", Value: database.Name() + "." + s.rules.Name()},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		next.Drop(ctx)
+		return err
+	}
+
+	return nil
+}
+
+func (s *MongoRewriteSaver) List() ([]*RewriteRule, error) {
+	ctx := context.Background()
+
+	opts := options.Find().SetSort(bson.D{{Key: "position", Value: 1}})
+	cursor, err := s.rules.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*RewriteRule, 0)
+
+	err = cursor.All(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type MemoryRewriteSaver struct {
+	mutex sync.Mutex
+	rules []RewriteRule
+}
+
+func NewMemoryRewriteSaver() RewriteSaver {
+	return &MemoryRewriteSaver{}
+}
+
+func (s *MemoryRewriteSaver) Replace(rules []*RewriteRule) error {
+	values := make([]RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Id.IsZero() {
+			rule.Id = primitive.NewObjectID()
+		}
+
+		values = append(values, *rule)
+	}
+
+	s.mutex.Lock()
+	s.rules = values
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *MemoryRewriteSaver) List() ([]*RewriteRule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := make([]*RewriteRule, 0, len(s.rules))
+	for _, value := range s.rules {
+		rule := value
+		res = append(res, &rule)
+	}
+
+	return res, nil
+}
+
+type SqliteRewriteSaver struct {
+	rules *sqliteCollection
+}
+
+func NewSqliteRewriteSaver(db *sql.DB) RewriteSaver {
+	return &SqliteRewriteSaver{
+		rules: newSqliteCollection(db, kRewriteRules),
+	}
+}
+
+func (s *SqliteRewriteSaver) Replace(rules []*RewriteRule) error {
+	tx, err := s.rules.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM " + kRewriteRules)
+	if err != nil {
+		return err
+	}
+
+	for i, rule := range rules {
+		if rule.Id.IsZero() {
+			rule.Id = primitive.NewObjectID()
+		}
+
+		document, err := bson.Marshal(bson.M{
+			"_id":      rule.Id,
+			"position": i,
+			"location": rule.Location,
+			"match":    rule.Match,
+			"replace":  rule.Replace,
+			"regex":    rule.Regex,
+			"disabled": rule.Disabled,
+			"comment":  rule.Comment,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = s.rules.put(tx, document)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteRewriteSaver) List() ([]*RewriteRule, error) {
+	documents, err := s.rules.find("", nil, "position", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*RewriteRule, 0, len(documents))
+
+	for _, document := range documents {
+		value := &RewriteRule{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,520 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations bring a database file up to date. PRAGMA user_version
+// counts the ones applied, so released migrations must never change, new
+// ones are appended.
+var sqliteMigrations = []string{
+	`
+	CREATE TABLE requests (id TEXT PRIMARY KEY, document BLOB NOT NULL, host TEXT, path TEXT, method TEXT);
+	CREATE INDEX requests_host ON requests (host);
+	CREATE INDEX requests_path ON requests (path);
+	CREATE INDEX requests_method ON requests (method);
+
+	CREATE TABLE responses (id TEXT PRIMARY KEY, document BLOB NOT NULL, request_id TEXT, code INTEGER);
+	CREATE INDEX responses_request_id ON responses (request_id);
+	CREATE INDEX responses_code ON responses (code);
+
+	CREATE TABLE messages (id TEXT PRIMARY KEY, document BLOB NOT NULL, request_id TEXT);
+	CREATE INDEX messages_request_id ON messages (request_id);
+
+	CREATE TABLE tunnels (id TEXT PRIMARY KEY, document BLOB NOT NULL, host TEXT);
+	CREATE INDEX tunnels_host ON tunnels (host);
+
+	CREATE TABLE pinning (id TEXT PRIMARY KEY, document BLOB NOT NULL, last_failure INTEGER);
+
+	CREATE TABLE rewrite_rules (id TEXT PRIMARY KEY, document BLOB NOT NULL, position INTEGER);
+
+	CREATE TABLE tokens (id TEXT PRIMARY KEY, document BLOB NOT NULL, hash TEXT);
+	CREATE INDEX tokens_hash ON tokens (hash);
+	`,
+}
+
+// sqliteColumns are the fields copied out of the documents of each table so
+// they can be filtered and sorted on.
+var sqliteColumns = map[string][]string{
+	kRequests:     {"host", "path", "method"},
+	kResponses:    {"request_id", "code"},
+	kMessages:     {"request_id"},
+	kTunnels:      {"host"},
+	kPinning:      {"last_failure"},
+	kRewriteRules: {"position"},
+	kTokens:       {"hash"},
+}
+
+// OpenSqlite opens the project file at path, creating it when needed, and
+// migrates its schema.
+func OpenSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// One connection serializes the writes, SQLite allows a single writer
+	// anyway.
+	db.SetMaxOpenConns(1)
+
+	err = migrateSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func migrateSqlite(db *sql.DB) error {
+	var version int
+
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports", version)
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[i])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type sqliteQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteCollection stores BSON documents the way they are stored in Mongo,
+// so they decode the same and move between the backends unchanged.
+type sqliteCollection struct {
+	db      *sql.DB
+	table   string
+	columns []string
+}
+
+func newSqliteCollection(db *sql.DB, table string) *sqliteCollection {
+	return &sqliteCollection{
+		db:      db,
+		table:   table,
+		columns: sqliteColumns[table],
+	}
+}
+
+// put inserts or replaces document, keyed by its _id.
+func (c *sqliteCollection) put(q sqliteQuerier, document bson.Raw) error {
+	id, ok := sqliteValue(document.Lookup("_id")).(string)
+	if !ok {
+		return errors.New("document has no _id")
+	}
+
+	names := append([]string{"id", "document"}, c.columns...)
+	args := []interface{}{id, []byte(document)}
+	for _, column := range c.columns {
+		args = append(args, sqliteValue(document.Lookup(column)))
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	query := "INSERT OR REPLACE INTO " + c.table + " (" + strings.Join(names, ", ") + ") VALUES (" + placeholders + ")"
+
+	_, err := q.Exec(query, args...)
+	return err
+}
+
+// insert stores value under a new id.
+func (c *sqliteCollection) insert(value bson.M) (primitive.ObjectID, error) {
+	id := primitive.NewObjectID()
+	value["_id"] = id
+
+	document, err := bson.Marshal(value)
+	if err != nil {
+		return id, err
+	}
+
+	return id, c.put(c.db, document)
+}
+
+func (c *sqliteCollection) getRaw(q sqliteQuerier, id string) (bson.Raw, error) {
+	var document []byte
+
+	err := q.QueryRow("SELECT document FROM "+c.table+" WHERE id = ?", id).Scan(&document)
+	if err == sql.ErrNoRows {
+		return nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (c *sqliteCollection) get(id string, value interface{}) error {
+	document, err := c.getRaw(c.db, id)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(document, value)
+}
+
+// update applies change to the document with id, inserting it when create
+// is set and there is none.
+func (c *sqliteCollection) update(id interface{}, create bool, change func(document bson.M)) error {
+	key, _ := sqliteValue(bsonValue(id)).(string)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	value := bson.M{}
+
+	document, err := c.getRaw(tx, key)
+	if err == mongo.ErrNoDocuments && create {
+		value["_id"] = id
+	} else if err != nil {
+		return err
+	} else {
+		err = bson.Unmarshal(document, &value)
+		if err != nil {
+			return err
+		}
+	}
+
+	change(value)
+
+	document, err = bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = c.put(tx, document)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// find returns the documents matching where, which may be empty, sorted by
+// order and at most limit of them when limit is positive.
+func (c *sqliteCollection) find(where string, args []interface{}, order string, limit int64) ([]bson.Raw, error) {
+	query := "SELECT document FROM " + c.table
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY " + order + " LIMIT ?"
+
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := c.db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]bson.Raw, 0)
+	for rows.Next() {
+		var document []byte
+
+		err = rows.Scan(&document)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, document)
+	}
+
+	return res, rows.Err()
+}
+
+func (c *sqliteCollection) delete(where string, args ...interface{}) (int64, error) {
+	query := "DELETE FROM " + c.table
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	res, err := c.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// sqliteValue converts a BSON field to what is stored in its column. Ids are
+// kept as hex and times as milliseconds, both sort like in Mongo.
+func sqliteValue(value bson.RawValue) interface{} {
+	switch value.Type {
+	case bsontype.String:
+		return value.StringValue()
+	case bsontype.ObjectID:
+		return value.ObjectID().Hex()
+	case bsontype.Int32:
+		return int64(value.Int32())
+	case bsontype.Int64:
+		return value.Int64()
+	case bsontype.DateTime:
+		return value.DateTime()
+	case bsontype.Boolean:
+		return value.Boolean()
+	}
+
+	return nil
+}
+
+func bsonValue(value interface{}) bson.RawValue {
+	kind, data, err := bson.MarshalValue(value)
+	if err != nil {
+		return bson.RawValue{}
+	}
+
+	return bson.RawValue{Type: kind, Value: data}
+}
+
+// objectIdKey checks that id is an ObjectID, like the Mongo lookups do, and
+// returns the key it is stored under.
+func objectIdKey(id string) (string, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", err
+	}
+
+	return objectId.Hex(), nil
+}
+
+// SqliteRequestSaver keeps requests in a SQLite project file.
+type SqliteRequestSaver struct {
+	requests *sqliteCollection
+	bodies   *BodyStore
+}
+
+type SqliteResponseSaver struct {
+	responses *sqliteCollection
+	bodies    *BodyStore
+}
+
+func NewSqliteRequestSaver(db *sql.DB, bodies *BodyStore) RequestSaver {
+	return &SqliteRequestSaver{
+		requests: newSqliteCollection(db, kRequests),
+		bodies:   bodies,
+	}
+}
+
+func NewSqliteResponseSaver(db *sql.DB, bodies *BodyStore) ResponseSaver {
+	return &SqliteResponseSaver{
+		responses: newSqliteCollection(db, kResponses),
+		bodies:    bodies,
+	}
+}
+
+func (s *SqliteRequestSaver) Save(req *http.Request) (string, error) {
+	value, err := requestDocument(req, s.bodies)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := s.requests.insert(value)
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *SqliteRequestSaver) Get(id string) (*Request, error) {
+	key, err := objectIdKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Request{}
+
+	err = s.requests.get(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqliteRequestSaver) GetEncoded(id string) (*http.Request, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return toRequest(value, s.bodies)
+}
+
+func (s *SqliteRequestSaver) Body(id string) (io.ReadCloser, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bodies.open(value.Body, value.BodyRef)
+}
+
+func (s *SqliteRequestSaver) List(limit int64) ([]*Request, error) {
+	documents, err := s.requests.find("", nil, "id DESC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Request, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Request{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+func (s *SqliteRequestSaver) Tag(id string, tag string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	return s.requests.update(objectId, false, func(document bson.M) {
+		tags, _ := document["tags"].(bson.A)
+		for _, elem := range tags {
+			if elem == tag {
+				return
+			}
+		}
+
+		document["tags"] = append(tags, tag)
+	})
+}
+
+func (s *SqliteResponseSaver) Save(requestId string, resp *http.Response) (string, error) {
+	value, err := responseDocument(requestId, resp, s.bodies)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := s.responses.insert(value)
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *SqliteResponseSaver) Get(id string) (*Response, error) {
+	key, err := objectIdKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	value := &Response{}
+
+	err = s.responses.get(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqliteResponseSaver) Body(id string) (io.ReadCloser, error) {
+	value, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.bodies.open(value.Body, value.BodyRef)
+}
+
+func (s *SqliteResponseSaver) GetByRequest(requestId string) (*Response, error) {
+	key, err := objectIdKey(requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := s.responses.find("request_id = ?", []interface{}{key}, "id", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(documents) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	value := &Response{}
+
+	err = bson.Unmarshal(documents[0], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqliteResponseSaver) List(limit int64) ([]*Response, error) {
+	documents, err := s.responses.find("", nil, "id DESC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Response, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Response{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TokenSaver stores API tokens. Only a hash of each token is kept, the token
+// itself is shown once when it is created.
+type TokenSaver interface {
+	Save(token *Token) (string, error)
+	GetByHash(hash string) (*Token, error)
+	List() ([]*Token, error)
+	Delete(id string) error
+}
+
+type Token struct {
+	Id      primitive.ObjectID `json:"id" bson:"_id"`
+	Name    string             `json:"name"`
+	Role    string             `json:"role"`
+	Hash    string             `json:"-"`
+	Created time.Time          `json:"created"`
+}
+
+const kTokens = "tokens"
+
+type MongoTokenSaver struct {
+	tokens *mongo.Collection
+}
+
+func NewMongoTokenSaver(conn *mongo.Client) TokenSaver {
+	return &MongoTokenSaver{
+		tokens: conn.Database(kDatabase).Collection(kTokens),
+	}
+}
+
+func (s *MongoTokenSaver) Save(token *Token) (string, error) {
+	res, err := s.tokens.InsertOne(context.Background(), bson.M{
+		"name":    token.Name,
+		"role":    token.Role,
+		"hash":    token.Hash,
+		"created": token.Created,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	token.Id = res.InsertedID.(primitive.ObjectID)
+	return token.Id.Hex(), nil
+}
+
+func (s *MongoTokenSaver) GetByHash(hash string) (*Token, error) {
+	res := s.tokens.FindOne(context.Background(), bson.D{{Key: "hash", Value: hash}})
+	value := &Token{}
+
+	err := res.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *MongoTokenSaver) List() ([]*Token, error) {
+	ctx := context.Background()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := s.tokens.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Token, 0)
+
+	err = cursor.All(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *MongoTokenSaver) Delete(id string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.tokens.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: objectId}})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+type MemoryTokenSaver struct {
+	mutex  sync.Mutex
+	tokens []Token
+}
+
+func NewMemoryTokenSaver() TokenSaver {
+	return &MemoryTokenSaver{}
+}
+
+func (s *MemoryTokenSaver) Save(token *Token) (string, error) {
+	token.Id = primitive.NewObjectID()
+
+	s.mutex.Lock()
+	s.tokens = append(s.tokens, *token)
+	s.mutex.Unlock()
+
+	return token.Id.Hex(), nil
+}
+
+func (s *MemoryTokenSaver) GetByHash(hash string) (*Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, value := range s.tokens {
+		if value.Hash == hash {
+			token := value
+			return &token, nil
+		}
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *MemoryTokenSaver) List() ([]*Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := make([]*Token, 0, len(s.tokens))
+	for _, value := range s.tokens {
+		token := value
+		res = append(res, &token)
+	}
+
+	return res, nil
+}
+
+func (s *MemoryTokenSaver) Delete(id string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, value := range s.tokens {
+		if value.Id == objectId {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return nil
+		}
+	}
+
+	return mongo.ErrNoDocuments
+}
+
+type SqliteTokenSaver struct {
+	tokens *sqliteCollection
+}
+
+func NewSqliteTokenSaver(db *sql.DB) TokenSaver {
+	return &SqliteTokenSaver{
+		tokens: newSqliteCollection(db, kTokens),
+	}
+}
+
+func (s *SqliteTokenSaver) Save(token *Token) (string, error) {
+	id, err := s.tokens.insert(bson.M{
+		"name":    token.Name,
+		"role":    token.Role,
+		"hash":    token.Hash,
+		"created": token.Created,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	token.Id = id
+	return token.Id.Hex(), nil
+}
+
+func (s *SqliteTokenSaver) GetByHash(hash string) (*Token, error) {
+	documents, err := s.tokens.find("hash = ?", []interface{}{hash}, "id", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(documents) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	value := &Token{}
+
+	err = bson.Unmarshal(documents[0], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *SqliteTokenSaver) List() ([]*Token, error) {
+	documents, err := s.tokens.find("", nil, "id", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Token, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Token{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+func (s *SqliteTokenSaver) Delete(id string) error {
+	key, err := objectIdKey(id)
+	if err != nil {
+		return err
+	}
+
+	count, err := s.tokens.delete("id = ?", key)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
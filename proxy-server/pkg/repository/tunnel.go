@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TunnelSaver stores metadata of tunnels that were relayed without
+// decryption. Their contents are never recorded.
+type TunnelSaver interface {
+	Save(tunnel *Tunnel) (string, error)
+	List(host string, limit int64) ([]*Tunnel, error)
+}
+
+type Tunnel struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Host      string             `json:"host"`
+	Port      string             `json:"port"`
+	BytesUp   int64              `json:"bytes_up" bson:"bytes_up"`
+	BytesDown int64              `json:"bytes_down" bson:"bytes_down"`
+	Started   time.Time          `json:"started"`
+	Duration  int64              `json:"duration_ms" bson:"duration_ms"`
+}
+
+const kTunnels = "tunnels"
+
+type MongoTunnelSaver struct {
+	tunnels *mongo.Collection
+}
+
+func NewMongoTunnelSaver(conn *mongo.Client) TunnelSaver {
+	return &MongoTunnelSaver{
+		tunnels: conn.Database(kDatabase).Collection(kTunnels),
+	}
+}
+
+func (s *MongoTunnelSaver) Save(tunnel *Tunnel) (string, error) {
+	res, err := s.tunnels.InsertOne(context.Background(), bson.M{
+		"host":        tunnel.Host,
+		"port":        tunnel.Port,
+		"bytes_up":    tunnel.BytesUp,
+		"bytes_down":  tunnel.BytesDown,
+		"started":     tunnel.Started,
+		"duration_ms": tunnel.Duration,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+// List returns the latest tunnels, only those to host when it is not empty.
+func (s *MongoTunnelSaver) List(host string, limit int64) ([]*Tunnel, error) {
+	ctx := context.Background()
+
+	filter := bson.D{}
+	if host != "" {
+		filter = bson.D{{Key: "host", Value: host}}
+	}
+
+	opts := options.Find().SetLimit(limit).SetSort(bson.D{{Key: "_id", Value: -1}})
+	cursor, err := s.tunnels.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Tunnel, 0, limit/2)
+
+	err = cursor.All(ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type MemoryTunnelSaver struct {
+	tunnels *memoryCollection
+}
+
+func NewMemoryTunnelSaver(maxEntries int, maxBytes int64) TunnelSaver {
+	return &MemoryTunnelSaver{
+		tunnels: newMemoryCollection(maxEntries, maxBytes),
+	}
+}
+
+func (s *MemoryTunnelSaver) Save(tunnel *Tunnel) (string, error) {
+	id, _, err := s.tunnels.insert(bson.M{
+		"host":        tunnel.Host,
+		"port":        tunnel.Port,
+		"bytes_up":    tunnel.BytesUp,
+		"bytes_down":  tunnel.BytesDown,
+		"started":     tunnel.Started,
+		"duration_ms": tunnel.Duration,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *MemoryTunnelSaver) List(host string, limit int64) ([]*Tunnel, error) {
+	documents := s.tunnels.find(limit, true, func(document bson.Raw) bool {
+		return host == "" || document.Lookup("host").StringValue() == host
+	})
+
+	res := make([]*Tunnel, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Tunnel{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+type SqliteTunnelSaver struct {
+	tunnels *sqliteCollection
+}
+
+func NewSqliteTunnelSaver(db *sql.DB) TunnelSaver {
+	return &SqliteTunnelSaver{
+		tunnels: newSqliteCollection(db, kTunnels),
+	}
+}
+
+func (s *SqliteTunnelSaver) Save(tunnel *Tunnel) (string, error) {
+	id, err := s.tunnels.insert(bson.M{
+		"host":        tunnel.Host,
+		"port":        tunnel.Port,
+		"bytes_up":    tunnel.BytesUp,
+		"bytes_down":  tunnel.BytesDown,
+		"started":     tunnel.Started,
+		"duration_ms": tunnel.Duration,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id.Hex(), nil
+}
+
+func (s *SqliteTunnelSaver) List(host string, limit int64) ([]*Tunnel, error) {
+	where, args := "", []interface{}{}
+	if host != "" {
+		where, args = "host = ?", []interface{}{host}
+	}
+
+	documents, err := s.tunnels.find(where, args, "id DESC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Tunnel, 0, len(documents))
+
+	for _, document := range documents {
+		value := &Tunnel{}
+
+		err := bson.Unmarshal(document, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
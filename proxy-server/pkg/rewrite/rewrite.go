@@ -0,0 +1,326 @@
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"proxy-server/pkg/repository"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	LocationRequestLine    = "request_line"
+	LocationRequestHeader  = "request_header"
+	LocationRequestBody    = "request_body"
+	LocationResponseHeader = "response_header"
+	LocationResponseBody   = "response_body"
+)
+
+const DefaultMaxBodySize = 10 << 20
+
+var errBadRequestLine = errors.New("rewritten request line is not METHOD URI PROTO")
+
+type rule struct {
+	location string
+	literal  string
+	regex    *regexp.Regexp
+	replace  string
+}
+
+func (r *rule) apply(s string) string {
+	if r.regex != nil {
+		return r.regex.ReplaceAllString(s, r.replace)
+	}
+
+	return strings.ReplaceAll(s, r.literal, r.replace)
+}
+
+// Engine applies the match-and-replace rules in their order. Bodies larger
+// than maxBodySize or with a Content-Encoding, and response bodies that are
+// streamed, are passed on untouched.
+type Engine struct {
+	mutex       sync.Mutex
+	source      []*repository.RewriteRule
+	rules       []*rule
+	maxBodySize int64
+}
+
+func NewEngine(maxBodySize int64) *Engine {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	return &Engine{
+		source:      make([]*repository.RewriteRule, 0),
+		maxBodySize: maxBodySize,
+	}
+}
+
+// SetRules checks and activates rules. The previous rules stay in place when
+// one of them is invalid. rules are read by the proxied requests from then
+// on and must not be changed afterwards.
+func (e *Engine) SetRules(rules []*repository.RewriteRule) error {
+	compiled, err := compile(rules)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	e.source = rules
+	e.rules = compiled
+	e.mutex.Unlock()
+
+	return nil
+}
+
+// Check reports the first invalid rule of rules.
+func Check(rules []*repository.RewriteRule) error {
+	_, err := compile(rules)
+	return err
+}
+
+func compile(rules []*repository.RewriteRule) ([]*rule, error) {
+	compiled := make([]*rule, 0, len(rules))
+
+	for _, elem := range rules {
+		switch elem.Location {
+		case LocationRequestLine, LocationRequestHeader, LocationRequestBody, LocationResponseHeader, LocationResponseBody:
+		default:
+			return nil, fmt.Errorf("unknown rewrite location %q", elem.Location)
+		}
+
+		value := &rule{
+			location: elem.Location,
+			literal:  elem.Match,
+			replace:  elem.Replace,
+		}
+
+		if elem.Regex {
+			var err error
+			value.regex, err = regexp.Compile(elem.Match)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !elem.Disabled {
+			compiled = append(compiled, value)
+		}
+	}
+
+	return compiled, nil
+}
+
+func (e *Engine) Rules() []*repository.RewriteRule {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.source
+}
+
+func (e *Engine) rulesFor(location string) []*rule {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	res := make([]*rule, 0)
+	for _, elem := range e.rules {
+		if elem.location == location {
+			res = append(res, elem)
+		}
+	}
+
+	return res
+}
+
+// ApplyRequest rewrites req in place before it is sent. The request line is
+// METHOD URI PROTO with the URI in origin-form, so it cannot change where the
+// request goes.
+func (e *Engine) ApplyRequest(req *http.Request) error {
+	rules := e.rulesFor(LocationRequestLine)
+	if len(rules) != 0 {
+		err := rewriteRequestLine(req, rules)
+		if err != nil {
+			return err
+		}
+	}
+
+	rules = e.rulesFor(LocationRequestHeader)
+	if len(rules) != 0 {
+		req.Header = rewriteHeader(req.Header, rules)
+	}
+
+	rules = e.rulesFor(LocationRequestBody)
+	if len(rules) == 0 || req.Body == nil || req.Body == http.NoBody || isEncoded(req.Header) {
+		return nil
+	}
+
+	body, ok, err := e.readBody(req.Body)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		req.Body = body
+		return nil
+	}
+
+	rewritten := rewriteBody(body, rules)
+	req.Body = io.NopCloser(bytes.NewReader(rewritten))
+	req.ContentLength = int64(len(rewritten))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+
+	return nil
+}
+
+// ApplyResponse rewrites resp in place before it is written to the client.
+func (e *Engine) ApplyResponse(resp *http.Response) error {
+	rules := e.rulesFor(LocationResponseHeader)
+	if len(rules) != 0 {
+		resp.Header = rewriteHeader(resp.Header, rules)
+	}
+
+	rules = e.rulesFor(LocationResponseBody)
+	if len(rules) == 0 || resp.Body == nil || resp.Body == http.NoBody || isEncoded(resp.Header) || isStreaming(resp) {
+		return nil
+	}
+
+	body, ok, err := e.readBody(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		resp.Body = body
+		return nil
+	}
+
+	rewritten := rewriteBody(body, rules)
+	resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+
+	return nil
+}
+
+// readBody reads body completely when it fits into maxBodySize. Otherwise it
+// returns a reader that yields the whole body again and false.
+func (e *Engine) readBody(body io.ReadCloser) (io.ReadCloser, bool, error) {
+	head, err := io.ReadAll(io.LimitReader(body, e.maxBodySize+1))
+	if err != nil {
+		body.Close()
+		return nil, false, err
+	}
+
+	if int64(len(head)) > e.maxBodySize {
+		return &joinedBody{Reader: io.MultiReader(bytes.NewReader(head), body), Closer: body}, false, nil
+	}
+
+	body.Close()
+	return io.NopCloser(bytes.NewReader(head)), true, nil
+}
+
+type joinedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func rewriteBody(body io.Reader, rules []*rule) []byte {
+	value, _ := io.ReadAll(body)
+
+	res := string(value)
+	for _, elem := range rules {
+		res = elem.apply(res)
+	}
+
+	return []byte(res)
+}
+
+func rewriteRequestLine(req *http.Request, rules []*rule) error {
+	line := req.Method + " " + req.URL.RequestURI() + " " + req.Proto
+	for _, elem := range rules {
+		line = elem.apply(line)
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return errBadRequestLine
+	}
+
+	target, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return err
+	}
+
+	req.Method = parts[0]
+	req.URL.Path = target.Path
+	req.URL.RawPath = target.RawPath
+	req.URL.RawQuery = target.RawQuery
+
+	return nil
+}
+
+// rewriteHeader runs the rules over every "Name: value" line. A line that
+// ends up empty removes the header, a rule with an empty match adds its
+// replacement as a new line.
+func rewriteHeader(header http.Header, rules []*rule) http.Header {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range header[key] {
+			lines = append(lines, key+": "+value)
+		}
+	}
+
+	for _, elem := range rules {
+		if elem.regex == nil && elem.literal == "" {
+			lines = append(lines, elem.replace)
+			continue
+		}
+
+		for i := range lines {
+			lines[i] = elem.apply(lines[i])
+		}
+	}
+
+	res := make(http.Header, len(lines))
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+
+		res.Add(key, strings.TrimSpace(value))
+	}
+
+	return res
+}
+
+// isStreaming reports whether resp is a long-lived stream, as server-sent
+// events and multipart replace streams are. Waiting for the whole body to
+// rewrite it would hold such responses back. Chunked responses of other types
+// are read up to maxBodySize like any other body.
+func isStreaming(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || mediaType == "multipart/x-mixed-replace"
+}
+
+func isEncoded(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
@@ -0,0 +1,97 @@
+package rewrite
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"proxy-server/pkg/repository"
+)
+
+func newChunkedResponse(contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode:       http.StatusOK,
+		Header:           http.Header{"Content-Type": {contentType}},
+		Body:             io.NopCloser(strings.NewReader(body)),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+	}
+}
+
+func newResponseEngine(t *testing.T, maxBodySize int64) *Engine {
+	t.Helper()
+
+	engine := NewEngine(maxBodySize)
+	err := engine.SetRules([]*repository.RewriteRule{
+		{Location: LocationResponseBody, Match: `"admin":false`, Replace: `"admin":true`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return engine
+}
+
+func readResponse(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestApplyResponseRewritesChunkedBody(t *testing.T) {
+	engine := newResponseEngine(t, 0)
+
+	resp := newChunkedResponse("application/json", `{"admin":false}`)
+	err := engine.ApplyResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := readResponse(t, resp)
+	if body != `{"admin":true}` {
+		t.Errorf("body is %q", body)
+	}
+
+	if resp.ContentLength != int64(len(body)) || resp.TransferEncoding != nil {
+		t.Errorf("length %d, transfer encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+func TestApplyResponsePassesOversizedChunkedBody(t *testing.T) {
+	engine := newResponseEngine(t, 16)
+
+	original := `{"admin":false,"padding":"` + strings.Repeat("x", 64) + `"}`
+	resp := newChunkedResponse("application/json", original)
+	err := engine.ApplyResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := readResponse(t, resp); body != original {
+		t.Errorf("body is %q", body)
+	}
+
+	if resp.ContentLength != -1 {
+		t.Errorf("length is %d", resp.ContentLength)
+	}
+}
+
+func TestApplyResponseSkipsEventStream(t *testing.T) {
+	engine := newResponseEngine(t, 0)
+
+	resp := newChunkedResponse("text/event-stream", `data: {"admin":false}`+"\n\n")
+	err := engine.ApplyResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := readResponse(t, resp); body != `data: {"admin":false}`+"\n\n" {
+		t.Errorf("body is %q", body)
+	}
+}
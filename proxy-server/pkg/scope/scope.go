@@ -0,0 +1,238 @@
+package scope
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"proxy-server/pkg/hostmatch"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	OutOfScopeSkip = "skip"
+	OutOfScopeTag  = "tag"
+)
+
+// Tag marks recorded requests that were out of scope.
+const Tag = "out-of-scope"
+
+// Rule matches traffic by scheme, host glob or CIDR, port and path prefix.
+// Empty fields match anything.
+type Rule struct {
+	Scheme string `json:"scheme,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// Config is a project scope. Traffic is in scope when it matches an include
+// rule, or there are none, and matches no exclude rule. OutOfScope tells
+// whether the rest is skipped or recorded with the out-of-scope tag.
+type Config struct {
+	Include    []*Rule `json:"include"`
+	Exclude    []*Rule `json:"exclude"`
+	OutOfScope string  `json:"out_of_scope"`
+}
+
+type Scope struct {
+	mutex  sync.Mutex
+	config Config
+}
+
+func New(config Config) (*Scope, error) {
+	s := &Scope{}
+
+	err := s.Set(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Scope) Set(config Config) error {
+	switch config.OutOfScope {
+	case "":
+		config.OutOfScope = OutOfScopeSkip
+	case OutOfScopeSkip, OutOfScopeTag:
+	default:
+		return fmt.Errorf("unknown out of scope mode %q", config.OutOfScope)
+	}
+
+	if config.Include == nil {
+		config.Include = make([]*Rule, 0)
+	}
+
+	if config.Exclude == nil {
+		config.Exclude = make([]*Rule, 0)
+	}
+
+	for _, rule := range append(config.Include, config.Exclude...) {
+		if rule == nil {
+			return errors.New("empty scope rule")
+		}
+
+		err := rule.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	s.config = config
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *Scope) Get() Config {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.config
+}
+
+// Tags reports whether out-of-scope traffic is recorded with a tag instead
+// of being skipped.
+func (s *Scope) Tags() bool {
+	return s.Get().OutOfScope == OutOfScopeTag
+}
+
+func (s *Scope) Contains(scheme, host, port, path string) bool {
+	config := s.Get()
+
+	included := len(config.Include) == 0
+	for _, rule := range config.Include {
+		if rule.matches(scheme, host, port, path) {
+			included = true
+			break
+		}
+	}
+
+	if !included {
+		return false
+	}
+
+	for _, rule := range config.Exclude {
+		if rule.matches(scheme, host, port, path) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ContainsURL checks an absolute URL, the port defaults to the one of its
+// scheme.
+func (s *Scope) ContainsURL(target *url.URL) bool {
+	port := target.Port()
+	if port == "" {
+		port = defaultPort(target.Scheme)
+	}
+
+	return s.Contains(target.Scheme, target.Hostname(), port, target.Path)
+}
+
+func (r *Rule) validate() error {
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("bad scope port %d", r.Port)
+	}
+
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("scope path %q does not start with /", r.Path)
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(scheme, host, port, path string) bool {
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, scheme) {
+		return false
+	}
+
+	if r.Host != "" && !hostmatch.Match(r.Host, host) {
+		return false
+	}
+
+	if r.Port != 0 && strconv.Itoa(r.Port) != port {
+		return false
+	}
+
+	return strings.HasPrefix(path, r.Path)
+}
+
+// ParseRule reads a rule given on the command line as
+// [scheme://]host[:port][/path], e.g. "https://*.example.com/api".
+func ParseRule(value string) (*Rule, error) {
+	rule := &Rule{}
+
+	scheme, rest, ok := strings.Cut(value, "://")
+	if ok {
+		rule.Scheme = scheme
+	} else {
+		rest = value
+	}
+
+	hostPort := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hostPort = rest[:i]
+		rule.Path = rest[i:]
+
+		// In 10.0.0.0/8 the slash starts the prefix length, not the path.
+		bits, path, hasPath := strings.Cut(rest[i+1:], "/")
+		_, _, err := net.ParseCIDR(hostPort + "/" + bits)
+		if err == nil {
+			hostPort += "/" + bits
+			rule.Path = ""
+			if hasPath {
+				rule.Path = "/" + path
+			}
+		}
+	}
+
+	rule.Host = hostPort
+	i := strings.LastIndex(hostPort, ":")
+	if i >= 0 && !strings.Contains(hostPort, "/") && !strings.HasSuffix(hostPort, "]") {
+		port, err := strconv.Atoi(hostPort[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad scope rule %q", value)
+		}
+
+		rule.Host = hostPort[:i]
+		rule.Port = port
+	}
+
+	rule.Host = strings.Trim(rule.Host, "[]")
+	if rule.Host == "*" {
+		rule.Host = ""
+	}
+
+	return rule, rule.validate()
+}
+
+// ParseRules reads rules given one per value, as ParseRule does.
+func ParseRules(values []string) ([]*Rule, error) {
+	res := make([]*Rule, 0, len(values))
+
+	for _, elem := range values {
+		rule, err := ParseRule(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, rule)
+	}
+
+	return res, nil
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" || scheme == "wss" {
+		return "443"
+	}
+
+	return "80"
+}
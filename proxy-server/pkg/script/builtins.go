@@ -0,0 +1,193 @@
+package script
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/starlarkstruct"
+)
+
+// newBuiltins returns what every script sees besides the Starlark
+// universe: hashing and encoding helpers, the json module, fetch for side
+// requests such as token refreshes and a store shared by all scripts.
+func newBuiltins() starlark.StringDict {
+	store := &store{values: make(map[string]starlark.Value)}
+
+	return starlark.StringDict{
+		"json":          starlarkjson.Module,
+		"hmac_sha256":   starlark.NewBuiltin("hmac_sha256", hmacSha256),
+		"sha256":        starlark.NewBuiltin("sha256", sha256Hex),
+		"base64_encode": starlark.NewBuiltin("base64_encode", base64Encode),
+		"base64_decode": starlark.NewBuiltin("base64_decode", base64Decode),
+		"now":           starlark.NewBuiltin("now", now),
+		"fetch":         starlark.NewBuiltin("fetch", fetch),
+		"store_get":     starlark.NewBuiltin("store_get", store.get),
+		"store_set":     starlark.NewBuiltin("store_set", store.set),
+	}
+}
+
+// hmac_sha256(key, msg) returns the hex encoded HMAC-SHA256 of msg.
+func hmacSha256(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "msg", &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg))
+
+	return starlark.String(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func sha256Hex(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "msg", &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(msg))
+	return starlark.String(hex.EncodeToString(sum[:])), nil
+}
+
+func base64Encode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "msg", &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.String(base64.StdEncoding.EncodeToString([]byte(msg))), nil
+}
+
+func base64Decode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "msg", &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.String(value), nil
+}
+
+// now() returns the current unix time in seconds.
+func now(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.Float(float64(time.Now().UnixNano()) / float64(time.Second)), nil
+}
+
+var fetchClient = &http.Client{Timeout: DefaultTimeout}
+
+// fetch(url, method="GET", headers={}, body="") sends a request directly,
+// not through the proxy, and returns a struct with status, headers and body.
+func fetch(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var target, body string
+	method := http.MethodGet
+	headers := &starlark.Dict{}
+
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &target, "method?", &method, "headers?", &headers, "body?", &body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range headers.Items() {
+		key, ok := starlark.AsString(item[0])
+		value, ok2 := starlark.AsString(item[1])
+		if ok && ok2 {
+			req.Header.Set(key, value)
+		}
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	value, err := io.ReadAll(io.LimitReader(resp.Body, DefaultMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("response"), starlark.StringDict{
+		"status":  starlark.MakeInt(resp.StatusCode),
+		"headers": headersToDict(resp.Header),
+		"body":    starlark.String(value),
+	}), nil
+}
+
+// store keeps values between hook calls, e.g. a refreshed token. Values are
+// frozen so concurrent hooks can share them.
+type store struct {
+	mutex  sync.Mutex
+	values map[string]starlark.Value
+}
+
+// store_get(key, default=None)
+func (s *store) get(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var fallback starlark.Value = starlark.None
+
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.values[key]
+	if !ok {
+		return fallback, nil
+	}
+
+	return value, nil
+}
+
+// store_set(key, value), a None value removes key.
+func (s *store) set(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var value starlark.Value
+
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "value", &value)
+	if err != nil {
+		return nil, err
+	}
+
+	value.Freeze()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if value == starlark.None {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+
+	return starlark.None, nil
+}
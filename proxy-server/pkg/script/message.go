@@ -0,0 +1,320 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"go.starlark.net/starlark"
+)
+
+// message exposes a request or a response to the hooks. Headers are changed
+// through header, set_header and del_header, method, status and body can be
+// assigned directly. A read-only message has no body.
+type message struct {
+	kind      string
+	readOnly  bool
+	req       *http.Request
+	resp      *http.Response
+	id        string
+	requestId string
+	body      *lazyBody
+}
+
+func newRequest(req *http.Request, id string, maxBodySize int64) *message {
+	return &message{
+		kind: "request",
+		req:  req,
+		id:   id,
+		body: &lazyBody{source: &req.Body, limit: maxBodySize},
+	}
+}
+
+func newResponse(resp *http.Response, requestId string, maxBodySize int64) *message {
+	return &message{
+		kind:      "response",
+		resp:      resp,
+		requestId: requestId,
+		body:      &lazyBody{source: &resp.Body, limit: maxBodySize},
+	}
+}
+
+func (m *message) String() string       { return fmt.Sprintf("<%s>", m.kind) }
+func (m *message) Type() string         { return m.kind }
+func (m *message) Freeze()              {}
+func (m *message) Truth() starlark.Bool { return starlark.True }
+func (m *message) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", m.kind)
+}
+
+func (m *message) header() http.Header {
+	if m.req != nil {
+		return m.req.Header
+	}
+
+	return m.resp.Header
+}
+
+func (m *message) AttrNames() []string {
+	if m.req != nil {
+		return []string{"body", "del_header", "header", "headers", "id", "method", "set_header", "url"}
+	}
+
+	return []string{"body", "del_header", "header", "headers", "request_id", "set_header", "status"}
+}
+
+func (m *message) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "header":
+		return starlark.NewBuiltin("header", m.getHeader), nil
+	case "set_header":
+		return starlark.NewBuiltin("set_header", m.setHeader), nil
+	case "del_header":
+		return starlark.NewBuiltin("del_header", m.delHeader), nil
+	case "headers":
+		return headersToDict(m.header()), nil
+	case "body":
+		if m.readOnly {
+			return starlark.None, nil
+		}
+		body, ok, err := m.body.get()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return starlark.None, nil
+		}
+		return starlark.String(body), nil
+	}
+
+	if m.req != nil {
+		switch name {
+		case "id":
+			return optionalString(m.id), nil
+		case "method":
+			return starlark.String(m.req.Method), nil
+		case "url":
+			return starlark.String(requestUrl(m.req)), nil
+		}
+	} else {
+		switch name {
+		case "request_id":
+			return optionalString(m.requestId), nil
+		case "status":
+			return starlark.MakeInt(m.resp.StatusCode), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *message) SetField(name string, val starlark.Value) error {
+	if m.readOnly {
+		return fmt.Errorf("%s is read-only", m.kind)
+	}
+
+	switch name {
+	case "body":
+		value, ok := starlark.AsString(val)
+		if !ok {
+			return fmt.Errorf("body must be a string, got %s", val.Type())
+		}
+		m.body.set(value)
+		return nil
+	case "method":
+		if m.req == nil {
+			break
+		}
+		value, ok := starlark.AsString(val)
+		if !ok || value == "" {
+			return fmt.Errorf("method must be a non-empty string")
+		}
+		m.req.Method = value
+		return nil
+	case "status":
+		if m.resp == nil {
+			break
+		}
+		status, err := starlark.AsInt32(val)
+		if err == nil && (status < 100 || status > 999) {
+			err = fmt.Errorf("status %d is out of range", status)
+		}
+		if err != nil {
+			return err
+		}
+		m.resp.StatusCode = status
+		m.resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+		return nil
+	}
+
+	return fmt.Errorf("%s has no settable field %s", m.kind, name)
+}
+
+func (m *message) getHeader(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name)
+	if err != nil {
+		return nil, err
+	}
+
+	values := m.header().Values(name)
+	if len(values) == 0 {
+		return starlark.None, nil
+	}
+
+	return starlark.String(values[0]), nil
+}
+
+func (m *message) setHeader(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, value string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "value", &value)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.readOnly {
+		return nil, fmt.Errorf("%s is read-only", m.kind)
+	}
+
+	m.header().Set(name, value)
+	return starlark.None, nil
+}
+
+func (m *message) delHeader(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.readOnly {
+		return nil, fmt.Errorf("%s is read-only", m.kind)
+	}
+
+	m.header().Del(name)
+	return starlark.None, nil
+}
+
+// commit writes a body changed by the hooks back into the message.
+func (m *message) commit() {
+	body, changed := m.body.result()
+	if !changed {
+		return
+	}
+
+	m.header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	if m.req != nil {
+		m.req.ContentLength = int64(len(body))
+		m.req.TransferEncoding = nil
+	} else {
+		m.resp.ContentLength = int64(len(body))
+		m.resp.TransferEncoding = nil
+	}
+}
+
+// lazyBody reads the body only when a hook asks for it. Bodies above limit
+// stay streamed and are seen as None.
+type lazyBody struct {
+	source  *io.ReadCloser
+	limit   int64
+	loaded  bool
+	tooBig  bool
+	value   []byte
+	changed bool
+}
+
+func (b *lazyBody) get() ([]byte, bool, error) {
+	if b.loaded {
+		return b.value, !b.tooBig, nil
+	}
+
+	b.loaded = true
+
+	body := *b.source
+	if body == nil || body == http.NoBody {
+		return nil, true, nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, b.limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(head)) > b.limit {
+		b.tooBig = true
+		*b.source = &joinedBody{Reader: io.MultiReader(bytes.NewReader(head), body), Closer: body}
+		return nil, false, nil
+	}
+
+	body.Close()
+	b.value = head
+	*b.source = io.NopCloser(bytes.NewReader(head))
+
+	return b.value, true, nil
+}
+
+func (b *lazyBody) set(value string) {
+	if !b.loaded || b.tooBig {
+		body := *b.source
+		if body != nil {
+			body.Close()
+		}
+	}
+
+	b.loaded = true
+	b.tooBig = false
+	b.changed = true
+	b.value = []byte(value)
+	*b.source = io.NopCloser(bytes.NewReader(b.value))
+}
+
+func (b *lazyBody) result() ([]byte, bool) {
+	return b.value, b.changed
+}
+
+type joinedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func headersToDict(header http.Header) *starlark.Dict {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := starlark.NewDict(len(keys))
+	for _, key := range keys {
+		values := make([]starlark.Value, 0, len(header[key]))
+		for _, value := range header[key] {
+			values = append(values, starlark.String(value))
+		}
+		res.SetKey(starlark.String(key), starlark.NewList(values))
+	}
+
+	return res
+}
+
+func optionalString(value string) starlark.Value {
+	if value == "" {
+		return starlark.None
+	}
+
+	return starlark.String(value)
+}
+
+// requestUrl is the absolute URL of req, also once the proxy cleared the host
+// from req.URL before sending it.
+func requestUrl(req *http.Request) string {
+	value := *req.URL
+	if value.Host == "" {
+		value.Host = req.Host
+	}
+
+	return value.String()
+}
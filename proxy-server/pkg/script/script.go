@@ -0,0 +1,265 @@
+package script
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const DefaultDir = "scripts"
+const DefaultReloadInterval = time.Second * 2
+const DefaultTimeout = time.Second * 5
+const DefaultMaxBodySize = 10 << 20
+
+const (
+	hookRequest  = "onRequest"
+	hookResponse = "onResponse"
+)
+
+// Config points the runner at a directory of Starlark files. Scripting is off
+// when Dir is empty.
+type Config struct {
+	Dir         string
+	MaxBodySize int64
+}
+
+// Script is one loaded file. When a new version fails to load, the previous
+// hooks stay active and Error tells why.
+type Script struct {
+	Name   string    `json:"name"`
+	Hooks  []string  `json:"hooks"`
+	Loaded time.Time `json:"loaded"`
+	Error  string    `json:"error,omitempty"`
+
+	modTime    time.Time
+	onRequest  starlark.Value
+	onResponse starlark.Value
+}
+
+// Runner calls the onRequest(req) and onResponse(req, resp) hooks of every
+// *.star file in the scripts directory, in file name order. The directory is
+// polled, so added, changed and removed files take effect without a restart.
+type Runner struct {
+	mutex       sync.Mutex
+	dir         string
+	maxBodySize int64
+	scripts     map[string]*Script
+	builtins    starlark.StringDict
+}
+
+func NewRunner(config Config) *Runner {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultMaxBodySize
+	}
+
+	r := &Runner{
+		dir:         config.Dir,
+		maxBodySize: config.MaxBodySize,
+		scripts:     make(map[string]*Script),
+		builtins:    newBuiltins(),
+	}
+
+	if r.dir != "" {
+		r.reload()
+		go r.watch()
+	}
+
+	return r
+}
+
+func (r *Runner) watch() {
+	ticker := time.NewTicker(DefaultReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.reload()
+	}
+}
+
+func (r *Runner) reload() {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("scripts:", err)
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".star") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		name := entry.Name()
+		present[name] = true
+
+		r.mutex.Lock()
+		previous := r.scripts[name]
+		r.mutex.Unlock()
+
+		if previous != nil && previous.modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		script := r.load(name, info.ModTime(), previous)
+
+		r.mutex.Lock()
+		r.scripts[name] = script
+		r.mutex.Unlock()
+	}
+
+	r.mutex.Lock()
+	for name := range r.scripts {
+		if !present[name] {
+			delete(r.scripts, name)
+			fmt.Println("script unloaded:", name)
+		}
+	}
+	r.mutex.Unlock()
+}
+
+func (r *Runner) load(name string, modTime time.Time, previous *Script) *Script {
+	thread := newThread(name)
+
+	timer := time.AfterFunc(DefaultTimeout, func() { thread.Cancel("timeout") })
+	globals, err := starlark.ExecFile(thread, filepath.Join(r.dir, name), nil, r.builtins)
+	timer.Stop()
+
+	if err != nil {
+		fmt.Println("script", name+":", err)
+
+		script := &Script{Name: name, Hooks: make([]string, 0), modTime: modTime, Error: err.Error()}
+		if previous != nil {
+			script.Hooks = previous.Hooks
+			script.Loaded = previous.Loaded
+			script.onRequest = previous.onRequest
+			script.onResponse = previous.onResponse
+		}
+
+		return script
+	}
+
+	script := &Script{Name: name, Hooks: make([]string, 0, 2), Loaded: time.Now(), modTime: modTime}
+
+	if hook, ok := globals[hookRequest].(starlark.Callable); ok {
+		script.onRequest = hook
+		script.Hooks = append(script.Hooks, hookRequest)
+	}
+
+	if hook, ok := globals[hookResponse].(starlark.Callable); ok {
+		script.onResponse = hook
+		script.Hooks = append(script.Hooks, hookResponse)
+	}
+
+	fmt.Println("script loaded:", name, script.Hooks)
+
+	return script
+}
+
+// List returns the scripts in the order their hooks run.
+func (r *Runner) List() []*Script {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make([]*Script, 0, len(r.scripts))
+	for _, script := range r.scripts {
+		res = append(res, script)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+func (r *Runner) hooks(name string) ([]string, []starlark.Value) {
+	names := make([]string, 0)
+	hooks := make([]starlark.Value, 0)
+
+	for _, script := range r.List() {
+		hook := script.onRequest
+		if name == hookResponse {
+			hook = script.onResponse
+		}
+
+		if hook != nil {
+			names = append(names, script.Name)
+			hooks = append(hooks, hook)
+		}
+	}
+
+	return names, hooks
+}
+
+// OnRequest runs the onRequest hooks on req before it is sent. The request is
+// recorded afterwards, so it has no id yet and the changes made by the hooks
+// are stored. A failing hook is reported and skipped, it never stops the
+// request.
+func (r *Runner) OnRequest(req *http.Request) {
+	names, hooks := r.hooks(hookRequest)
+	if len(hooks) == 0 {
+		return
+	}
+
+	msg := newRequest(req, "", r.maxBodySize)
+	for i, hook := range hooks {
+		call(names[i], hook, starlark.Tuple{msg})
+	}
+
+	msg.commit()
+}
+
+// OnResponse runs the onResponse hooks on resp before it is written to the
+// client. The request is passed along read-only and without its body, which
+// has been sent by then. requestId is empty only when the request was not
+// recorded, as for requests skipped for being out of scope.
+func (r *Runner) OnResponse(req *http.Request, resp *http.Response, requestId string) {
+	names, hooks := r.hooks(hookResponse)
+	if len(hooks) == 0 {
+		return
+	}
+
+	reqMsg := newRequest(req, requestId, r.maxBodySize)
+	reqMsg.readOnly = true
+
+	msg := newResponse(resp, requestId, r.maxBodySize)
+	for i, hook := range hooks {
+		call(names[i], hook, starlark.Tuple{reqMsg, msg})
+	}
+
+	msg.commit()
+}
+
+func call(name string, hook starlark.Value, args starlark.Tuple) {
+	thread := newThread(name)
+
+	timer := time.AfterFunc(DefaultTimeout, func() { thread.Cancel("timeout") })
+	defer timer.Stop()
+
+	_, err := starlark.Call(thread, hook, args, nil)
+	if err != nil {
+		fmt.Println("script", name+":", err)
+	}
+}
+
+func newThread(name string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			fmt.Println(thread.Name+":", msg)
+		},
+	}
+}
@@ -0,0 +1,208 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const kVersion = 0x05
+
+const (
+	kMethodNoAuth       = 0x00
+	kMethodPassword     = 0x02
+	kMethodNoAcceptable = 0xFF
+)
+
+const kCommandConnect = 0x01
+
+const (
+	kAddressIPv4   = 0x01
+	kAddressDomain = 0x03
+	kAddressIPv6   = 0x04
+)
+
+const (
+	kReplySucceeded           = 0x00
+	kReplyCommandNotSupported = 0x07
+	kReplyAddressNotSupported = 0x08
+)
+
+var ErrAuthFailed = errors.New("socks: authentication failed")
+
+// Credentials reports whether a username and password given by a client are
+// valid.
+type Credentials func(username, password string) bool
+
+// Accept negotiates a SOCKS5 session on conn and reads the CONNECT request.
+// When credentials is nil no authentication is required, otherwise the
+// client has to authenticate with username and password. On success the
+// client is told that the connection is established right away, because the
+// caller decides how to reach the destination only after it has seen the
+// first bytes of the tunnel. The host, the port and the authenticated user
+// are returned.
+func Accept(conn io.ReadWriter, credentials Credentials) (string, string, string, error) {
+	user, err := negotiate(conn, credentials)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var head [4]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if head[0] != kVersion {
+		return "", "", "", fmt.Errorf("socks: unsupported version %d", head[0])
+	}
+
+	host, err := readAddress(conn, head[3])
+	if err != nil {
+		writeReply(conn, kReplyAddressNotSupported)
+		return "", "", "", err
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(conn, port[:])
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if head[1] != kCommandConnect {
+		writeReply(conn, kReplyCommandNotSupported)
+		return "", "", "", fmt.Errorf("socks: unsupported command %d", head[1])
+	}
+
+	err = writeReply(conn, kReplySucceeded)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))), user, nil
+}
+
+func negotiate(conn io.ReadWriter, credentials Credentials) (string, error) {
+	var head [2]byte
+	_, err := io.ReadFull(conn, head[:])
+	if err != nil {
+		return "", err
+	}
+
+	if head[0] != kVersion {
+		return "", fmt.Errorf("socks: unsupported version %d", head[0])
+	}
+
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+
+	wanted := byte(kMethodNoAuth)
+	if credentials != nil {
+		wanted = kMethodPassword
+	}
+
+	supported := false
+	for _, method := range methods {
+		if method == wanted {
+			supported = true
+		}
+	}
+
+	if !supported {
+		conn.Write([]byte{kVersion, kMethodNoAcceptable})
+		return "", errors.New("socks: no acceptable authentication method")
+	}
+
+	_, err = conn.Write([]byte{kVersion, wanted})
+	if err != nil {
+		return "", err
+	}
+
+	if wanted == kMethodPassword {
+		return authenticate(conn, credentials)
+	}
+
+	return "", nil
+}
+
+// authenticate runs the username/password subnegotiation from RFC 1929 and
+// returns the authenticated user.
+func authenticate(conn io.ReadWriter, credentials Credentials) (string, error) {
+	var version [1]byte
+	_, err := io.ReadFull(conn, version[:])
+	if err != nil {
+		return "", err
+	}
+
+	user, err := readString(conn)
+	if err != nil {
+		return "", err
+	}
+
+	pass, err := readString(conn)
+	if err != nil {
+		return "", err
+	}
+
+	if !credentials(user, pass) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", ErrAuthFailed
+	}
+
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return user, err
+}
+
+// Password returns Credentials accepting only username with password.
+func Password(username, password string) Credentials {
+	return func(user, pass string) bool {
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		return userOk && passOk
+	}
+}
+
+func readString(r io.Reader) (string, error) {
+	var length [1]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return "", err
+	}
+
+	value := make([]byte, length[0])
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func readAddress(r io.Reader, addressType byte) (string, error) {
+	switch addressType {
+	case kAddressIPv4:
+		address := make([]byte, net.IPv4len)
+		_, err := io.ReadFull(r, address)
+		return net.IP(address).String(), err
+	case kAddressIPv6:
+		address := make([]byte, net.IPv6len)
+		_, err := io.ReadFull(r, address)
+		return net.IP(address).String(), err
+	case kAddressDomain:
+		return readString(r)
+	default:
+		return "", fmt.Errorf("socks: unsupported address type %d", addressType)
+	}
+}
+
+func writeReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{kVersion, code, 0x00, kAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
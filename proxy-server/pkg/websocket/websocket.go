@@ -0,0 +1,359 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// MaxPayloadSize limits the frames ReadFrame holds in memory. Frames relayed
+// with ReadHeader and CopyPayload may be of any size.
+const MaxPayloadSize = 32 << 20
+
+const kAcceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const kCopyBufferSize = 32 << 10
+
+// Header is the part of a frame before its payload.
+type Header struct {
+	Fin     bool
+	Rsv     byte
+	Opcode  byte
+	Masked  bool
+	MaskKey [4]byte
+	Length  uint64
+}
+
+func (h *Header) IsControl() bool {
+	return h.Opcode&0x8 != 0
+}
+
+type Frame struct {
+	Fin     bool
+	Rsv     byte
+	Opcode  byte
+	Masked  bool
+	MaskKey [4]byte
+	// Payload is always kept unmasked.
+	Payload []byte
+}
+
+func (f *Frame) IsControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// ReadHeader reads the head of the next frame, its payload of Length bytes
+// follows on r.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	header := &Header{
+		Fin:    head[0]&0x80 != 0,
+		Rsv:    (head[0] >> 4) & 0x7,
+		Opcode: head[0] & 0xF,
+		Masked: head[1]&0x80 != 0,
+		Length: uint64(head[1] & 0x7F),
+	}
+
+	switch header.Length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(r, extended[:])
+		header.Length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(r, extended[:])
+		header.Length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Masked {
+		_, err = io.ReadFull(r, header.MaskKey[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return header, nil
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Length > MaxPayloadSize {
+		return nil, fmt.Errorf("websocket frame of %d bytes exceeds limit", header.Length)
+	}
+
+	frame := &Frame{
+		Fin:     header.Fin,
+		Rsv:     header.Rsv,
+		Opcode:  header.Opcode,
+		Masked:  header.Masked,
+		MaskKey: header.MaskKey,
+		Payload: make([]byte, header.Length),
+	}
+
+	_, err = io.ReadFull(r, frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if frame.Masked {
+		mask(frame.Payload, frame.MaskKey, 0)
+	}
+
+	return frame, nil
+}
+
+// CopyPayload streams the payload that follows header from src to dst as it
+// is, still masked, and writes it unmasked to capture as well when that is
+// not nil.
+func CopyPayload(dst io.Writer, src io.Reader, header *Header, capture io.Writer) error {
+	buffer := make([]byte, kCopyBufferSize)
+
+	for offset := uint64(0); offset < header.Length; {
+		chunk := buffer
+		if left := header.Length - offset; left < uint64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		_, err := io.ReadFull(src, chunk)
+		if err != nil {
+			return err
+		}
+
+		_, err = dst.Write(chunk)
+		if err != nil {
+			return err
+		}
+
+		if capture != nil {
+			if header.Masked {
+				mask(chunk, header.MaskKey, offset)
+			}
+
+			_, err = capture.Write(chunk)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += uint64(len(chunk))
+	}
+
+	return nil
+}
+
+func WriteHeader(w io.Writer, header *Header) error {
+	_, err := w.Write(encodeHeader(header))
+	return err
+}
+
+func encodeHeader(h *Header) []byte {
+	header := make([]byte, 2, 14)
+
+	header[0] = h.Rsv<<4 | h.Opcode&0xF
+	if h.Fin {
+		header[0] |= 0x80
+	}
+
+	switch {
+	case h.Length < 126:
+		header[1] = byte(h.Length)
+	case h.Length <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(h.Length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], h.Length)
+	}
+
+	if h.Masked {
+		header[1] |= 0x80
+		header = append(header, h.MaskKey[:]...)
+	}
+
+	return header
+}
+
+func WriteFrame(w io.Writer, frame *Frame) error {
+	header := encodeHeader(&Header{
+		Fin:     frame.Fin,
+		Rsv:     frame.Rsv,
+		Opcode:  frame.Opcode,
+		Masked:  frame.Masked,
+		MaskKey: frame.MaskKey,
+		Length:  uint64(len(frame.Payload)),
+	})
+
+	payload := frame.Payload
+	if frame.Masked {
+		payload = make([]byte, len(frame.Payload))
+		copy(payload, frame.Payload)
+		mask(payload, frame.MaskKey, 0)
+	}
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// mask applies key to payload, which starts offset bytes into the payload of
+// its frame.
+func mask(payload []byte, key [4]byte, offset uint64) {
+	for i := range payload {
+		payload[i] ^= key[(offset+uint64(i))%4]
+	}
+}
+
+func IsUpgrade(header http.Header) bool {
+	return hasToken(header.Get("Connection"), "upgrade") &&
+		strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+func hasToken(value, token string) bool {
+	for _, elem := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(elem), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conn is a client side connection opened by Dial.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial performs a client handshake for req, which must use the http or https
+// scheme, and returns the open connection together with the 101 response.
+func Dial(req *http.Request, dialer ContextDialer, cfg *tls.Config, timeout time.Duration) (*Conn, *http.Response, error) {
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	connection, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.URL.Scheme == "https" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+
+		tlsConnection := tls.Client(connection, cfg)
+		err = tlsConnection.HandshakeContext(ctx)
+		if err != nil {
+			connection.Close()
+			return nil, nil, err
+		}
+
+		connection = tlsConnection
+	}
+
+	var nonce [16]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Del("Sec-WebSocket-Extensions")
+
+	connection.SetDeadline(time.Now().Add(timeout))
+	defer connection.SetDeadline(time.Time{})
+
+	err = req.Write(connection)
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(connection)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		connection.Close()
+		return nil, resp, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		connection.Close()
+		return nil, resp, errors.New("websocket handshake failed: bad Sec-WebSocket-Accept")
+	}
+
+	return &Conn{Conn: connection, reader: reader}, resp, nil
+}
+
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + kAcceptGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (c *Conn) ReadFrame() (*Frame, error) {
+	return ReadFrame(c.reader)
+}
+
+// WriteFrame sends frame masked with a fresh key, as required from clients.
+func (c *Conn) WriteFrame(frame *Frame) error {
+	_, err := rand.Read(frame.MaskKey[:])
+	if err != nil {
+		return err
+	}
+
+	frame.Masked = true
+	return WriteFrame(c.Conn, frame)
+}